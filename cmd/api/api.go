@@ -1,14 +1,33 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/dawumnam/token-trader/config"
+	"github.com/dawumnam/token-trader/db"
+	"github.com/dawumnam/token-trader/service/order"
+	"github.com/dawumnam/token-trader/service/settlement"
+	"github.com/dawumnam/token-trader/service/token"
+	"github.com/dawumnam/token-trader/service/token/blockchain"
 	"github.com/dawumnam/token-trader/service/user"
 	"github.com/gorilla/mux"
 )
 
+const (
+	readTimeout     = 10 * time.Second
+	writeTimeout    = 30 * time.Second
+	idleTimeout     = 120 * time.Second
+	shutdownTimeout = 30 * time.Second
+)
+
 type APIServer struct {
 	addr string
 	db   *sql.DB
@@ -21,15 +40,111 @@ func NewAPIServer(addr string, db *sql.DB) *APIServer {
 	}
 }
 
+// Run serves the API and runs the background workers until SIGINT or SIGTERM,
+// then stops accepting connections and waits for in-flight requests and the
+// workers to finish
 func (s *APIServer) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	router := mux.NewRouter()
 	subrouter := router.PathPrefix("/api/v1").Subrouter()
 
+	tokenManager, err := blockchain.NewTokenManager(config.Envs)
+	if err != nil {
+		return err
+	}
+	defer tokenManager.Close()
+
+	txManager := db.NewTxManager(s.db)
 	userRepository := user.NewRepository(s.db)
+	tokenRepository := token.NewTokenRepository(s.db)
+	orderRepository := order.NewOrderRepository(s.db)
+	settlementRepository := settlement.NewRepository(s.db)
+
 	userHandler := user.NewHandler(userRepository)
 	userHandler.RegisterRoutes(subrouter)
 
-	log.Println("Listening on", s.addr)
+	tokenDeployer := token.NewDeployer(tokenRepository, txManager, tokenManager)
+	tokenHandler := token.NewHandler(tokenRepository, userRepository, txManager, tokenDeployer)
+	tokenHandler.RegisterRoutes(subrouter)
+
+	orderHandler := order.NewHandler(orderRepository, tokenRepository, userRepository, txManager)
+	orderHandler.RegisterRoutes(subrouter)
+	orderExpirySweeper := order.NewExpirySweeper(orderRepository, tokenRepository, txManager)
+	auctionRunner := order.NewAuctionRunner(orderRepository, tokenRepository, txManager)
+
+	settlementService := settlement.NewService(
+		settlementRepository,
+		tokenRepository,
+		userRepository,
+		txManager,
+		tokenManager,
+		time.Duration(config.Envs.SettlementInterval)*time.Second,
+		int(config.Envs.SettlementBatchSize),
+	)
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	var workers sync.WaitGroup
+	for _, run := range []func(context.Context){
+		tokenDeployer.Run,
+		orderExpirySweeper.Run,
+		auctionRunner.Run,
+		settlementService.Run,
+	} {
+		workers.Add(1)
+		go func(run func(context.Context)) {
+			defer workers.Done()
+			run(workerCtx)
+		}(run)
+	}
+
+	server := &http.Server{
+		Addr:         s.addr,
+		Handler:      router,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("Listening on", s.addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		stopWorkers()
+		workers.Wait()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Println("Timed out waiting for in-flight requests")
+	}
+
+	stopWorkers()
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Println("Timed out waiting for background workers")
+	}
 
-	return http.ListenAndServe(s.addr, router)
+	return err
 }
@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    DROP COLUMN `filledAmount`,
+    MODIFY COLUMN `status` ENUM('open', 'filled', 'cancelled') NOT NULL DEFAULT 'open';
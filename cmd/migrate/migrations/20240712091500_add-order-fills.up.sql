@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    ADD COLUMN `filledAmount` DECIMAL(65, 0) NOT NULL DEFAULT 0 AFTER `amount`,
+    MODIFY COLUMN `status` ENUM('open', 'partially_filled', 'filled', 'cancelled') NOT NULL DEFAULT 'open';
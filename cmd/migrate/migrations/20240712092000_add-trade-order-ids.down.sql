@@ -0,0 +1,5 @@
+ALTER TABLE trades
+    DROP FOREIGN KEY `fk_trades_buy_order`,
+    DROP FOREIGN KEY `fk_trades_sell_order`,
+    DROP COLUMN `buyOrderID`,
+    DROP COLUMN `sellOrderID`;
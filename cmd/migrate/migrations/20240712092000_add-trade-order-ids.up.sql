@@ -0,0 +1,5 @@
+ALTER TABLE trades
+    ADD COLUMN `buyOrderID` INT UNSIGNED NULL AFTER `buyerID`,
+    ADD COLUMN `sellOrderID` INT UNSIGNED NULL AFTER `buyOrderID`,
+    ADD CONSTRAINT `fk_trades_buy_order` FOREIGN KEY (buyOrderID) REFERENCES orders(id),
+    ADD CONSTRAINT `fk_trades_sell_order` FOREIGN KEY (sellOrderID) REFERENCES orders(id);
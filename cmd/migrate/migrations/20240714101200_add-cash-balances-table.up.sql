@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS cash_balances (
+    `id` INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    `userID` INT UNSIGNED NOT NULL,
+    `amount` DECIMAL(65, 0) NOT NULL,
+    FOREIGN KEY (userID) REFERENCES users(id),
+    UNIQUE KEY (userID)
+);
@@ -0,0 +1 @@
+UPDATE orders SET `status` = 'cancelled' WHERE `orderType` = 'buy' AND `status` IN ('open', 'partially_filled');
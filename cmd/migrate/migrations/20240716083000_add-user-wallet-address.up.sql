@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN `walletAddress` VARCHAR(42) NULL AFTER `email`;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS settlement_batches (
+    `id` INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    `fromTradeID` INT UNSIGNED NOT NULL,
+    `toTradeID` INT UNSIGNED NOT NULL,
+    `status` ENUM('pending', 'settled', 'failed') NOT NULL DEFAULT 'pending',
+    `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `settledAt` TIMESTAMP NULL,
+    UNIQUE KEY (toTradeID)
+);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS settlement_transfers (
+    `id` INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    `batchID` INT UNSIGNED NOT NULL,
+    `tokenID` INT UNSIGNED NOT NULL,
+    `fromUserID` INT UNSIGNED NOT NULL,
+    `toUserID` INT UNSIGNED NOT NULL,
+    `amount` DECIMAL(65, 0) NOT NULL,
+    `fromAddress` VARCHAR(42) NULL,
+    `toAddress` VARCHAR(42) NULL,
+    `txHash` VARCHAR(66) NULL,
+    `status` ENUM('pending', 'submitting', 'submitted', 'confirmed', 'skipped', 'failed') NOT NULL DEFAULT 'pending',
+    `error` VARCHAR(255) NULL,
+    `updatedAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (batchID) REFERENCES settlement_batches(id),
+    FOREIGN KEY (tokenID) REFERENCES tokens(id),
+    FOREIGN KEY (fromUserID) REFERENCES users(id),
+    FOREIGN KEY (toUserID) REFERENCES users(id)
+);
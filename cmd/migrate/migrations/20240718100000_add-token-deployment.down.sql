@@ -0,0 +1,7 @@
+ALTER TABLE tokens
+    DROP COLUMN `deployError`,
+    DROP COLUMN `blockNumber`,
+    DROP COLUMN `deployTxHash`,
+    DROP COLUMN `status`,
+    DROP COLUMN `initialSupply`,
+    MODIFY COLUMN `contractAddress` VARCHAR(42) NOT NULL;
@@ -0,0 +1,7 @@
+ALTER TABLE tokens
+    MODIFY COLUMN `contractAddress` VARCHAR(42) NULL,
+    ADD COLUMN `initialSupply` DECIMAL(65, 0) NOT NULL DEFAULT 0 AFTER `ownerID`,
+    ADD COLUMN `status` ENUM('pending', 'deployed', 'failed') NOT NULL DEFAULT 'pending' AFTER `initialSupply`,
+    ADD COLUMN `deployTxHash` VARCHAR(66) NULL AFTER `status`,
+    ADD COLUMN `blockNumber` BIGINT UNSIGNED NULL AFTER `deployTxHash`,
+    ADD COLUMN `deployError` TEXT NULL AFTER `blockNumber`;
@@ -0,0 +1 @@
+UPDATE tokens SET `contractAddress` = UUID() WHERE `contractAddress` IS NULL;
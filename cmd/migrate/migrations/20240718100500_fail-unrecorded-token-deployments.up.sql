@@ -0,0 +1,3 @@
+UPDATE tokens
+SET `contractAddress` = NULL, `status` = 'failed', `deployError` = 'contract address was not recorded'
+WHERE `contractAddress` NOT LIKE '0x%';
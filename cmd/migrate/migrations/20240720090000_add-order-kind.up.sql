@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN `kind` ENUM('limit', 'market') NOT NULL DEFAULT 'limit' AFTER `orderType`;
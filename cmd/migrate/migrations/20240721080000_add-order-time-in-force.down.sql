@@ -0,0 +1,4 @@
+ALTER TABLE orders
+    DROP INDEX `idx_orders_expiry`,
+    DROP COLUMN `expiresAt`,
+    DROP COLUMN `timeInForce`;
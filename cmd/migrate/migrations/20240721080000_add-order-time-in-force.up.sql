@@ -0,0 +1,4 @@
+ALTER TABLE orders
+    ADD COLUMN `timeInForce` ENUM('GTC', 'IOC', 'FOK', 'GTD') NOT NULL DEFAULT 'GTC' AFTER `kind`,
+    ADD COLUMN `expiresAt` TIMESTAMP NULL AFTER `status`,
+    ADD INDEX `idx_orders_expiry` (`timeInForce`, `status`, `expiresAt`);
@@ -0,0 +1,5 @@
+ALTER TABLE orders
+    DROP INDEX `idx_orders_trigger`,
+    DROP COLUMN `triggerPrice`,
+    MODIFY COLUMN `status` ENUM('open', 'partially_filled', 'filled', 'cancelled') NOT NULL DEFAULT 'open',
+    MODIFY COLUMN `kind` ENUM('limit', 'market') NOT NULL DEFAULT 'limit';
@@ -0,0 +1,5 @@
+ALTER TABLE orders
+    MODIFY COLUMN `kind` ENUM('limit', 'market', 'stop', 'stop_limit') NOT NULL DEFAULT 'limit',
+    MODIFY COLUMN `status` ENUM('open', 'partially_filled', 'filled', 'cancelled', 'pending_trigger') NOT NULL DEFAULT 'open',
+    ADD COLUMN `triggerPrice` DECIMAL(65, 0) NULL AFTER `price`,
+    ADD INDEX `idx_orders_trigger` (`tokenID`, `status`, `triggerPrice`);
@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    ADD COLUMN `postOnly` BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN `reduceOnly` BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,4 @@
+ALTER TABLE orders
+    DROP COLUMN `priorityAt`,
+    DROP COLUMN `visibleAmount`,
+    DROP COLUMN `displayAmount`;
@@ -0,0 +1,4 @@
+ALTER TABLE orders
+    ADD COLUMN `displayAmount` DECIMAL(65, 0) NULL,
+    ADD COLUMN `visibleAmount` DECIMAL(65, 0) NULL,
+    ADD COLUMN `priorityAt` TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6);
@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN `selfTradePrevention` ENUM('cancel_newest', 'cancel_oldest', 'cancel_both', 'decrement') NOT NULL DEFAULT 'cancel_newest';
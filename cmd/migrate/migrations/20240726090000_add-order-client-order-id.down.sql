@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    DROP INDEX `idx_orders_client_order_id`,
+    DROP COLUMN `clientOrderId`;
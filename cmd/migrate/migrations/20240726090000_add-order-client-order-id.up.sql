@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    ADD COLUMN `clientOrderId` VARCHAR(64) NULL,
+    ADD UNIQUE INDEX `idx_orders_client_order_id` (`userID`, `clientOrderId`);
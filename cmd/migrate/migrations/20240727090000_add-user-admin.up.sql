@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN `isAdmin` BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS trading_halts (
+    `tokenID` INT UNSIGNED NOT NULL PRIMARY KEY,
+    `reason` VARCHAR(255) NOT NULL,
+    `haltedAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `resumesAt` TIMESTAMP NULL,
+    FOREIGN KEY (tokenID) REFERENCES tokens(id)
+);
@@ -0,0 +1,6 @@
+ALTER TABLE tokens
+    DROP COLUMN `minNotional`,
+    DROP COLUMN `maxQuantity`,
+    DROP COLUMN `minQuantity`,
+    DROP COLUMN `lotSize`,
+    DROP COLUMN `tickSize`;
@@ -0,0 +1,6 @@
+ALTER TABLE tokens
+    ADD COLUMN `tickSize` DECIMAL(65, 0) NOT NULL DEFAULT 1,
+    ADD COLUMN `lotSize` DECIMAL(65, 0) NOT NULL DEFAULT 1,
+    ADD COLUMN `minQuantity` DECIMAL(65, 0) NOT NULL DEFAULT 1,
+    ADD COLUMN `maxQuantity` DECIMAL(65, 0) NULL,
+    ADD COLUMN `minNotional` DECIMAL(65, 0) NOT NULL DEFAULT 0;
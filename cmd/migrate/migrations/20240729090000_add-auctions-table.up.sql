@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS auctions (
+    `id` INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    `tokenID` INT UNSIGNED NOT NULL,
+    `startsAt` TIMESTAMP NOT NULL,
+    `endsAt` TIMESTAMP NOT NULL,
+    `status` ENUM('scheduled', 'uncrossed') NOT NULL DEFAULT 'scheduled',
+    `price` DECIMAL(65, 0) NULL,
+    `volume` DECIMAL(65, 0) NULL,
+    `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (tokenID, status, startsAt),
+    FOREIGN KEY (tokenID) REFERENCES tokens(id)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS order_links (
+    `orderID` INT UNSIGNED NOT NULL PRIMARY KEY,
+    `linkedOrderID` INT UNSIGNED NOT NULL,
+    FOREIGN KEY (orderID) REFERENCES orders(id),
+    FOREIGN KEY (linkedOrderID) REFERENCES orders(id)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE trades
+    DROP INDEX `idx_trades_token_sequence`,
+    DROP COLUMN `aggressorSide`,
+    DROP COLUMN `sequence`;
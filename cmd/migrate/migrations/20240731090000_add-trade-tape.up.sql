@@ -0,0 +1,4 @@
+ALTER TABLE trades
+    ADD COLUMN `aggressorSide` ENUM('buy', 'sell') NULL,
+    ADD COLUMN `sequence` BIGINT UNSIGNED NULL,
+    ADD UNIQUE INDEX `idx_trades_token_sequence` (`tokenID`, `sequence`);
@@ -0,0 +1 @@
+UPDATE trades SET `sequence` = NULL;
@@ -0,0 +1,4 @@
+UPDATE trades
+JOIN (SELECT id, ROW_NUMBER() OVER (PARTITION BY tokenID ORDER BY id) AS tokenSequence FROM trades) numbered
+  ON numbered.id = trades.id
+SET trades.`sequence` = numbered.tokenSequence;
@@ -0,0 +1 @@
+ALTER TABLE trades MODIFY COLUMN `sequence` BIGINT UNSIGNED NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE trades
+    DROP FOREIGN KEY `fk_trades_settlement_batch`,
+    DROP COLUMN `settlementBatchID`;
@@ -0,0 +1,3 @@
+ALTER TABLE trades
+    ADD COLUMN `settlementBatchID` INT UNSIGNED NULL,
+    ADD CONSTRAINT `fk_trades_settlement_batch` FOREIGN KEY (settlementBatchID) REFERENCES settlement_batches(id);
@@ -0,0 +1 @@
+UPDATE trades SET `settlementBatchID` = NULL;
@@ -0,0 +1,3 @@
+UPDATE trades
+JOIN settlement_batches ON trades.id > settlement_batches.fromTradeID AND trades.id <= settlement_batches.toTradeID
+SET trades.`settlementBatchID` = settlement_batches.id;
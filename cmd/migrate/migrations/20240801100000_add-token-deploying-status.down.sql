@@ -0,0 +1,3 @@
+ALTER TABLE tokens
+    DROP COLUMN `deployRawTx`,
+    MODIFY COLUMN `status` ENUM('pending', 'deployed', 'failed') NOT NULL DEFAULT 'pending';
@@ -0,0 +1,3 @@
+ALTER TABLE tokens
+    MODIFY COLUMN `status` ENUM('pending', 'deployed', 'failed', 'deploying') NOT NULL DEFAULT 'pending',
+    ADD COLUMN `deployRawTx` BLOB NULL;
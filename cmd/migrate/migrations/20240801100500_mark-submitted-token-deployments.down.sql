@@ -0,0 +1 @@
+UPDATE tokens SET `status` = 'pending' WHERE `status` = 'deploying';
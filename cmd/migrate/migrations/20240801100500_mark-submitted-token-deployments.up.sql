@@ -0,0 +1 @@
+UPDATE tokens SET `status` = 'deploying' WHERE `status` = 'pending' AND `deployTxHash` IS NOT NULL;
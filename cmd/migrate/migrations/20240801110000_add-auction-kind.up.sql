@@ -0,0 +1 @@
+ALTER TABLE auctions ADD COLUMN `kind` ENUM('opening', 'closing') NOT NULL DEFAULT 'opening';
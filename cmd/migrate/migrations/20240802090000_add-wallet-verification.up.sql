@@ -0,0 +1,3 @@
+ALTER TABLE users
+    ADD COLUMN `walletVerified` BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN `walletNonce` VARCHAR(64) NULL;
@@ -17,8 +17,17 @@ type Config struct {
 	DBName                 string
 	JWTExpirationInSeconds int64
 	JWTSecret              string
+	ChainBackend           string
+	ChainRPCURL            string
+	ChainID                int64
 	ChainPrivateKey        string
 	PlatformAddress        string
+	SettlementInterval     int64
+	SettlementBatchSize    int64
+	MarketSlippageBps      int64
+	CircuitBreakerPercent  int64
+	CircuitBreakerWindow   int64
+	CircuitBreakerCooldown int64
 }
 
 var Envs = initConfig()
@@ -38,10 +47,22 @@ func initConfig() Config {
 		DBName:                 getEnv("DB_NAME", "token-trader"),
 		JWTExpirationInSeconds: getIntEnv("JWT_EXP", 3600*24*1),
 		JWTSecret:              getEnv("JWT_SECRET", "somesecret"),
+		ChainBackend:           getEnv("CHAIN_BACKEND", "rpc"),
+		ChainRPCURL:            getEnv("CHAIN_RPC_URL", "https://rpc.sepolia.linea.build"),
+		ChainID:                getIntEnv("CHAIN_ID", 0),
 		ChainPrivateKey:        getEnv("CHAIN_PK", "ad80f301c7c1f30bffd51128638d20f6dde70245a5fe5b4ef9560c7d157bf150"),
 		// NOT REAL PRIVATE KEY ASSOCIATED WITH ANY COINS
 		// PLACED HERE ONLY FOR TESTING PURPOSES
-		PlatformAddress: getEnv("PLATFORM_ADDR", "0x066322cE1C277E30b1c885D24692D66A186073EE"),
+		PlatformAddress:     getEnv("PLATFORM_ADDR", "0x066322cE1C277E30b1c885D24692D66A186073EE"),
+		SettlementInterval:  getIntEnv("SETTLEMENT_INTERVAL", 60),
+		SettlementBatchSize: getIntEnv("SETTLEMENT_BATCH_SIZE", 500),
+		MarketSlippageBps:   getIntEnv("MARKET_SLIPPAGE_BPS", 500),
+		// trading on a token halts for the cooldown once its price moves
+		// more than the percentage within the window, both in seconds. A
+		// percentage of 0 turns the breaker off.
+		CircuitBreakerPercent:  getIntEnv("CIRCUIT_BREAKER_PCT", 0),
+		CircuitBreakerWindow:   getIntEnv("CIRCUIT_BREAKER_WINDOW", 300),
+		CircuitBreakerCooldown: getIntEnv("CIRCUIT_BREAKER_COOLDOWN", 300),
 	}
 }
 
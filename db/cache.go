@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"time"
@@ -16,6 +17,14 @@ var (
 
 const (
 	BlacklistedTokensSet = "blacklisted_tokens"
+	orderBookVersionKey  = "order_book_version:%d"
+	orderBookKey         = "order_book:%d:%d:%d"
+	orderBookTTL         = time.Minute
+	tradeTapeKey         = "trade_tape:%d"
+	tradeTapeRetries     = 5
+
+	// TradeTapeLength is how many of a token's latest trades its tape keeps
+	TradeTapeLength = 100
 )
 
 func Init() {
@@ -57,3 +66,107 @@ func IsTokenBlacklisted(token string) (bool, error) {
 
 	return false, nil
 }
+
+// GetOrderBookVersion returns the number of times a token's book has been
+// invalidated. Cached books are keyed by it, so reading the version before the
+// book means a book read from an older state is never served after a change.
+func GetOrderBookVersion(tokenID uint) (int64, error) {
+	version, err := redisClient.Get(ctx, fmt.Sprintf(orderBookVersionKey, tokenID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get order book version: %w", err)
+	}
+	return version, nil
+}
+
+// GetCachedOrderBook returns the cached book for a version and depth, or nil if
+// there is none
+func GetCachedOrderBook(tokenID uint, version int64, depth int) ([]byte, error) {
+	book, err := redisClient.Get(ctx, fmt.Sprintf(orderBookKey, tokenID, version, depth)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cached order book: %w", err)
+	}
+	return book, nil
+}
+
+func CacheOrderBook(tokenID uint, version int64, depth int, book []byte) error {
+	err := redisClient.Set(ctx, fmt.Sprintf(orderBookKey, tokenID, version, depth), book, orderBookTTL).Err()
+	if err != nil {
+		return fmt.Errorf("failed to cache order book: %w", err)
+	}
+	return nil
+}
+
+// InvalidateOrderBook must be called after every committed change to a token's
+// book
+func InvalidateOrderBook(tokenID uint) error {
+	err := redisClient.Incr(ctx, fmt.Sprintf(orderBookVersionKey, tokenID)).Err()
+	if err != nil {
+		return fmt.Errorf("failed to invalidate order book: %w", err)
+	}
+	return nil
+}
+
+// GetTradeTape returns up to count of the token's latest trades from its tape,
+// newest first. The tape is empty until AppendTradeTape first fills it.
+func GetTradeTape(tokenID uint, count int) ([]string, error) {
+	trades, err := redisClient.LRange(ctx, fmt.Sprintf(tradeTapeKey, tokenID), 0, int64(count-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trade tape: %w", err)
+	}
+	return trades, nil
+}
+
+// AppendTradeTape pushes the token's trades that are newer than the latest one
+// on its tape and trims the tape to TradeTapeLength. newer loads the encoded
+// trades after a sequence number, oldest first. Appends that race with another
+// are retried, so trades never end up on the tape twice or out of order.
+func AppendTradeTape(tokenID uint, newer func(afterSequence uint64) ([][]byte, error)) error {
+	key := fmt.Sprintf(tradeTapeKey, tokenID)
+	appendNewer := func(tx *redis.Tx) error {
+		var afterSequence uint64
+		latest, err := tx.LIndex(ctx, key, 0).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			var trade struct {
+				Sequence uint64 `json:"sequence"`
+			}
+			if err := json.Unmarshal(latest, &trade); err != nil {
+				return err
+			}
+			afterSequence = trade.Sequence
+		}
+
+		trades, err := newer(afterSequence)
+		if err != nil || len(trades) == 0 {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, trade := range trades {
+				pipe.LPush(ctx, key, trade)
+			}
+			pipe.LTrim(ctx, key, 0, TradeTapeLength-1)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < tradeTapeRetries; i++ {
+		err := redisClient.Watch(ctx, appendNewer, key)
+		if err == nil {
+			return nil
+		}
+		if err != redis.TxFailedErr {
+			return fmt.Errorf("failed to append to trade tape: %w", err)
+		}
+	}
+	return fmt.Errorf("failed to append to trade tape: too many concurrent appends")
+}
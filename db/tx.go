@@ -13,8 +13,10 @@ func NewTxManager(db *sql.DB) *TxManager {
 	return &TxManager{db: db}
 }
 
+// RunInTransaction runs fn in a READ COMMITTED transaction, so reads made after
+// taking a lock see everything committed before the lock was granted
 func (tm *TxManager) RunInTransaction(ctx context.Context, fn func(*sql.Tx) error) error {
-	tx, err := tm.db.BeginTx(ctx, nil)
+	tx, err := tm.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,358 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/dawumnam/token-trader/db"
+	"github.com/dawumnam/token-trader/types"
+)
+
+const (
+	auctionRunInterval  = time.Second
+	auctionRunBatchSize = 100
+)
+
+var errInAuction = errors.New("the book is in a call auction")
+
+// InAuction reports whether the token's book is collecting orders for a call
+// auction, which it does from the start of an auction until it uncrosses. A
+// closing auction closes the book once it uncrosses, and it collects orders
+// until the next auction opens it again.
+func (m *Matcher) InAuction(tx *sql.Tx, tokenID uint) (bool, error) {
+	auction, err := m.tokenRepo.GetNextAuction(tx, tokenID)
+	if err != nil {
+		return false, err
+	}
+	if auction != nil && !auction.StartsAt.After(time.Now()) {
+		return true, nil
+	}
+
+	last, err := m.tokenRepo.GetLastAuction(tx, tokenID)
+	if err != nil || last == nil {
+		return false, err
+	}
+	return last.Kind == "closing", nil
+}
+
+// IndicativePrice returns the price and volume the token's book would uncross
+// at right now, or nil if nothing would trade
+func (m *Matcher) IndicativePrice(tx *sql.Tx, tokenID uint) (*big.Int, *big.Int, error) {
+	buys, sells, err := m.auctionOrders(tx, tokenID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	price, volume := equilibrium(buys, sells)
+	return price, volume, nil
+}
+
+// Uncross trades every buy and sell that cross at the book's equilibrium price
+// at that one price, in priority order on both sides, and returns the price
+// and the volume traded. Orders are never matched with orders of the same
+// user, so the volume may fall short of what the equilibrium promised.
+func (m *Matcher) Uncross(tx *sql.Tx, tokenID uint) (*big.Int, *big.Int, error) {
+	buys, sells, err := m.auctionOrders(tx, tokenID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	price, volume := equilibrium(buys, sells)
+	if price == nil {
+		return nil, nil, nil
+	}
+
+	traded := big.NewInt(0)
+	for _, buy := range buys {
+		if traded.Cmp(volume) == 0 || buy.Price.Cmp(price) < 0 {
+			break
+		}
+
+		filled := false
+		for _, sell := range sells {
+			if traded.Cmp(volume) == 0 || buy.RemainingAmount.Sign() == 0 || sell.Price.Cmp(price) > 0 {
+				break
+			}
+			if sell.RemainingAmount.Sign() == 0 || sell.UserID == buy.UserID {
+				continue
+			}
+
+			quantity := minAmount(buy.RemainingAmount, sell.RemainingAmount)
+			quantity = minAmount(quantity, new(big.Int).Sub(volume, traded))
+			if _, err := m.fill(tx, buy, sell, quantity, price, ""); err != nil {
+				return nil, nil, err
+			}
+			traded.Add(traded, quantity)
+			filled = true
+		}
+
+		if !filled {
+			continue
+		}
+		if buy.DisplayAmount != nil {
+			buy.VisibleAmount = minAmount(buy.DisplayAmount, buy.RemainingAmount)
+		}
+		if err := m.orderRepo.UpdateOrderFill(tx, buy); err != nil {
+			return nil, nil, err
+		}
+		if err := m.cancelLinked(tx, buy); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if traded.Sign() == 0 {
+		return nil, nil, nil
+	}
+	return price, traded, nil
+}
+
+// MatchCrossed trades the buys and sells of different users that still cross
+// after an uncross, which skips trades between orders of the same user and so
+// can leave a cross behind them. Each pair trades as in continuous trading,
+// at the price of the order that was placed first, with the other order as
+// the aggressor.
+func (m *Matcher) MatchCrossed(tx *sql.Tx, tokenID uint) error {
+	buys, sells, err := m.auctionOrders(tx, tokenID)
+	if err != nil {
+		return err
+	}
+
+	for _, buy := range buys {
+		filled := false
+		for _, sell := range sells {
+			if buy.RemainingAmount.Sign() == 0 || sell.Price.Cmp(buy.Price) > 0 {
+				break
+			}
+			if sell.RemainingAmount.Sign() == 0 || sell.UserID == buy.UserID {
+				continue
+			}
+
+			price, aggressorSide := buy.Price, sell.OrderType
+			if sell.ID < buy.ID {
+				price, aggressorSide = sell.Price, buy.OrderType
+			}
+			quantity := minAmount(buy.RemainingAmount, sell.RemainingAmount)
+			if _, err := m.fill(tx, buy, sell, quantity, price, aggressorSide); err != nil {
+				return err
+			}
+			filled = true
+		}
+
+		if !filled {
+			continue
+		}
+		if buy.DisplayAmount != nil {
+			buy.VisibleAmount = minAmount(buy.DisplayAmount, buy.RemainingAmount)
+		}
+		if err := m.orderRepo.UpdateOrderFill(tx, buy); err != nil {
+			return err
+		}
+		if err := m.cancelLinked(tx, buy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auctionOrders returns the buys and sells on the token's book in priority
+// order. The hidden part of iceberg orders takes part in an auction too.
+func (m *Matcher) auctionOrders(tx *sql.Tx, tokenID uint) ([]*types.Order, []*types.Order, error) {
+	var sides [2][]*types.Order
+	for i, orderType := range []string{"buy", "sell"} {
+		orders, err := m.orderRepo.GetOpenOrders(tx, tokenID, orderType)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, order := range orders {
+			if !isExpired(order) {
+				sides[i] = append(sides[i], order)
+			}
+		}
+	}
+	return sides[0], sides[1], nil
+}
+
+// equilibrium finds the price, out of the prices of the orders, at which the
+// most volume crosses. Ties go to the price that leaves the least volume
+// unmatched on either side, then to the middle of the prices still tied.
+func equilibrium(buys, sells []*types.Order) (*big.Int, *big.Int) {
+	var prices []*big.Int
+	seen := map[string]bool{}
+	for _, order := range append(append([]*types.Order{}, buys...), sells...) {
+		if !seen[order.Price.String()] {
+			seen[order.Price.String()] = true
+			prices = append(prices, order.Price)
+		}
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Cmp(prices[j]) < 0 })
+
+	var best []*big.Int
+	bestVolume, bestImbalance := big.NewInt(0), big.NewInt(0)
+	for _, price := range prices {
+		demand, supply := big.NewInt(0), big.NewInt(0)
+		for _, buy := range buys {
+			if buy.Price.Cmp(price) >= 0 {
+				demand.Add(demand, buy.RemainingAmount)
+			}
+		}
+		for _, sell := range sells {
+			if sell.Price.Cmp(price) <= 0 {
+				supply.Add(supply, sell.RemainingAmount)
+			}
+		}
+
+		volume := minAmount(demand, supply)
+		imbalance := new(big.Int).Abs(new(big.Int).Sub(demand, supply))
+		if volume.Sign() == 0 {
+			continue
+		}
+
+		switch cmp := volume.Cmp(bestVolume); {
+		case cmp > 0 || (cmp == 0 && imbalance.Cmp(bestImbalance) < 0):
+			best = []*big.Int{price}
+			bestVolume, bestImbalance = volume, imbalance
+		case cmp == 0 && imbalance.Cmp(bestImbalance) == 0:
+			best = append(best, price)
+		}
+	}
+
+	if len(best) == 0 {
+		return nil, nil
+	}
+	return best[(len(best)-1)/2], bestVolume
+}
+
+// AuctionRunner uncrosses call auctions once they end and hands their books
+// over to continuous trading, or closes them after a closing auction
+type AuctionRunner struct {
+	orderRepo types.OrderRepository
+	tokenRepo types.TokenRepository
+	txManager *db.TxManager
+	matcher   *Matcher
+	// now is the clock auctions are due by
+	now func() time.Time
+}
+
+func NewAuctionRunner(orderRepo types.OrderRepository, tokenRepo types.TokenRepository, txManager *db.TxManager) *AuctionRunner {
+	return &AuctionRunner{
+		orderRepo: orderRepo,
+		tokenRepo: tokenRepo,
+		txManager: txManager,
+		matcher:   NewMatcher(orderRepo, tokenRepo),
+		now:       time.Now,
+	}
+}
+
+// Run uncrosses due auctions once per interval until ctx is cancelled
+func (a *AuctionRunner) Run(ctx context.Context) {
+	ticker := time.NewTicker(auctionRunInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.RunDue(ctx); err != nil {
+			log.Printf("auction run failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue uncrosses every auction that has ended so far. Auctions on halted
+// tokens wait until trading resumes.
+func (a *AuctionRunner) RunDue(ctx context.Context) error {
+	for {
+		var auctions []*types.Auction
+		err := a.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+			var err error
+			auctions, err = a.tokenRepo.GetDueAuctions(tx, a.now(), auctionRunBatchSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		uncrossedAll := true
+		for _, auction := range auctions {
+			uncrossed, err := a.uncross(ctx, auction.ID)
+			if err != nil {
+				return err
+			}
+			uncrossedAll = uncrossedAll && uncrossed
+		}
+
+		// halted auctions would be listed again straight away
+		if len(auctions) < auctionRunBatchSize || !uncrossedAll || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (a *AuctionRunner) uncross(ctx context.Context, auctionID uint) (bool, error) {
+	var tokenID uint
+	var uncrossed bool
+	err := a.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+		auction, err := a.tokenRepo.GetAuctionByID(tx, auctionID)
+		if err != nil {
+			return err
+		}
+		tokenID = auction.TokenID
+
+		if err := a.orderRepo.LockOrderBook(tx, auction.TokenID); err != nil {
+			return err
+		}
+
+		// the auction may have uncrossed since it was listed
+		auction, err = a.tokenRepo.GetAuctionByID(tx, auctionID)
+		if err != nil || auction.Status != "scheduled" {
+			return err
+		}
+
+		status, err := a.orderRepo.GetTradingStatus(tx, auction.TokenID)
+		if err != nil || status.Halted {
+			return err
+		}
+
+		auction.Price, auction.Volume, err = a.matcher.Uncross(tx, auction.TokenID)
+		if err != nil {
+			return err
+		}
+
+		auction.Status = "uncrossed"
+		if err := a.tokenRepo.FinishAuction(tx, auction); err != nil {
+			return err
+		}
+		uncrossed = true
+
+		// a book handed over to continuous trading must not stay crossed
+		inAuction, err := a.matcher.InAuction(tx, auction.TokenID)
+		if err != nil {
+			return err
+		}
+		if !inAuction {
+			if err := a.matcher.MatchCrossed(tx, auction.TokenID); err != nil {
+				return err
+			}
+		}
+
+		// the auction's trades set the token's first or latest trade price. The
+		// book may still be in an auction if another one has started or this
+		// one closed it, and then nothing triggers yet.
+		return a.matcher.ProcessTriggers(tx, auction.TokenID)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	invalidateBook(tokenID)
+	publishTrades(ctx, a.orderRepo, a.txManager, tokenID)
+	return uncrossed, nil
+}
@@ -0,0 +1,571 @@
+package order
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dawumnam/token-trader/types"
+)
+
+const basisPoints = 10000
+
+var (
+	errInsufficientBalance = errors.New("insufficient balance")
+	errInsufficientFunds   = errors.New("insufficient funds")
+	errNoLiquidity         = errors.New("no orders to match against")
+	errWouldCross          = errors.New("post-only order would take liquidity")
+)
+
+// Matcher crosses incoming orders against the resting book of a token using
+// price-time priority. Callers must hold the book lock for the token.
+type Matcher struct {
+	orderRepo types.OrderRepository
+	tokenRepo types.TokenRepository
+}
+
+func NewMatcher(orderRepo types.OrderRepository, tokenRepo types.TokenRepository) *Matcher {
+	return &Matcher{orderRepo: orderRepo, tokenRepo: tokenRepo}
+}
+
+// Match fills taker against the opposite side of the book, best price first and
+// in queue order within a price, until either the taker is filled or the best
+// resting price no longer crosses. Every fill executes at the resting order's
+// price. The taker must already be persisted with its balance reserved.
+func (m *Matcher) Match(tx *sql.Tx, taker *types.Order) ([]*types.Trade, error) {
+	trades := []*types.Trade{}
+
+	// an iceberg maker that shows its next slice goes to the back of the
+	// queue, so the book is read again whenever that happens
+	for requeued := true; requeued && taker.RemainingAmount.Sign() > 0; {
+		makers, err := m.orderRepo.GetOpenOrders(tx, taker.TokenID, oppositeSide(taker.OrderType))
+		if err != nil {
+			return nil, err
+		}
+
+		requeued = false
+		for _, maker := range makers {
+			if taker.RemainingAmount.Sign() == 0 || !crosses(taker, maker.Price) {
+				break
+			}
+
+			if maker.UserID == taker.UserID {
+				if err := m.preventSelfTrade(tx, taker, maker); err != nil {
+					return nil, err
+				}
+				if !isOpen(taker) {
+					break
+				}
+				continue
+			}
+
+			quantity := minAmount(taker.RemainingAmount, displayed(maker))
+			requeued = maker.DisplayAmount != nil && quantity.Cmp(maker.VisibleAmount) == 0 && quantity.Cmp(maker.RemainingAmount) < 0
+
+			trade, err := m.fill(tx, taker, maker, quantity, maker.Price, taker.OrderType)
+			if err != nil {
+				return nil, err
+			}
+			trades = append(trades, trade)
+
+			if requeued {
+				break
+			}
+		}
+	}
+
+	if len(trades) > 0 {
+		// an iceberg taker trades its full size and only starts showing a
+		// slice once it rests
+		if taker.DisplayAmount != nil {
+			taker.VisibleAmount = minAmount(taker.DisplayAmount, taker.RemainingAmount)
+		}
+		if err := m.orderRepo.UpdateOrderFill(tx, taker); err != nil {
+			return nil, err
+		}
+		if err := m.cancelLinked(tx, taker); err != nil {
+			return nil, err
+		}
+	}
+
+	return trades, nil
+}
+
+// Execute fills quantity of a resting order for a user who takes it directly
+// instead of placing an order of their own. If the order is the user's own,
+// selfTradePrevention is applied instead and no trade is returned.
+func (m *Matcher) Execute(tx *sql.Tx, maker *types.Order, userID uint, quantity *big.Int, selfTradePrevention string) (*types.Trade, error) {
+	if maker.UserID == userID {
+		// there is no newer order to cancel, so cancelling it just means not
+		// trading
+		switch selfTradePrevention {
+		case "cancel_oldest", "cancel_both":
+			return nil, m.CancelRemaining(tx, maker)
+		case "decrement":
+			return nil, m.decrement(tx, maker, quantity)
+		}
+		return nil, nil
+	}
+
+	taker := &types.Order{
+		UserID:          userID,
+		TokenID:         maker.TokenID,
+		OrderType:       oppositeSide(maker.OrderType),
+		Amount:          quantity,
+		FilledAmount:    big.NewInt(0),
+		RemainingAmount: quantity,
+		Price:           maker.Price,
+	}
+
+	if err := m.Reserve(tx, taker); err != nil {
+		return nil, err
+	}
+
+	return m.fill(tx, taker, maker, quantity, maker.Price, taker.OrderType)
+}
+
+// Reserve takes what an order can spend out of its owner's balances: the
+// tokens for a sell, or price * amount of cash for a buy
+func (m *Matcher) Reserve(tx *sql.Tx, order *types.Order) error {
+	return m.reserve(tx, order, reservation(order))
+}
+
+// Release hands back whatever is still reserved for an order's remaining
+// amount
+func (m *Matcher) Release(tx *sql.Tx, order *types.Order) error {
+	return m.reserve(tx, order, new(big.Int).Neg(reservation(order)))
+}
+
+// Amend changes the price and total amount of an order on the book, reserving
+// or handing back only the difference. Lowering the amount keeps the order's
+// place in the queue; any other change sends it to the back, and a new price
+// may cross the book.
+func (m *Matcher) Amend(tx *sql.Tx, order *types.Order, price, amount *big.Int) ([]*types.Trade, error) {
+	if amount.Cmp(order.FilledAmount) <= 0 {
+		return nil, fmt.Errorf("amount must be more than the filled amount")
+	}
+
+	repriced := price.Cmp(order.Price) != 0
+	requeue := repriced || amount.Cmp(order.Amount) > 0
+	reserved := reservation(order)
+	increase := new(big.Int).Sub(amount, order.Amount)
+
+	order.Price = price
+	order.Amount = amount
+	order.RemainingAmount = new(big.Int).Sub(amount, order.FilledAmount)
+	if order.DisplayAmount != nil {
+		if requeue {
+			order.VisibleAmount = minAmount(order.DisplayAmount, order.RemainingAmount)
+		} else {
+			order.VisibleAmount = minAmount(order.VisibleAmount, order.RemainingAmount)
+		}
+	}
+
+	if order.ReduceOnly && increase.Sign() > 0 {
+		if err := m.checkSellable(tx, order, increase); err != nil {
+			return nil, err
+		}
+	}
+
+	if order.PostOnly && repriced {
+		wouldCross, err := m.WouldCross(tx, order)
+		if err != nil {
+			return nil, err
+		}
+		if wouldCross {
+			return nil, errWouldCross
+		}
+	}
+
+	if err := m.reserve(tx, order, new(big.Int).Sub(reservation(order), reserved)); err != nil {
+		return nil, err
+	}
+
+	if err := m.orderRepo.AmendOrder(tx, order); err != nil {
+		return nil, err
+	}
+
+	if requeue {
+		if err := m.orderRepo.RequeueOrder(tx, order.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if !repriced {
+		return []*types.Trade{}, nil
+	}
+	return m.Match(tx, order)
+}
+
+// CanFill reports whether the book holds enough at prices crossing order to
+// fill all of its remaining amount before Match reaches one of the user's own
+// orders that would cancel it
+func (m *Matcher) CanFill(tx *sql.Tx, order *types.Order) (bool, error) {
+	makers, err := m.orderRepo.GetOpenOrders(tx, order.TokenID, oppositeSide(order.OrderType))
+	if err != nil {
+		return false, err
+	}
+
+	available := big.NewInt(0)
+	for _, maker := range makers {
+		if !crosses(order, maker.Price) {
+			break
+		}
+		// the user's own orders never trade with it, and under cancel_newest
+		// and cancel_both the first of them cancels what is left of it
+		if maker.UserID == order.UserID {
+			if order.SelfTradePrevention == "cancel_oldest" || order.SelfTradePrevention == "decrement" {
+				continue
+			}
+			return false, nil
+		}
+		available.Add(available, maker.RemainingAmount)
+		if available.Cmp(order.RemainingAmount) >= 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// WouldCross reports whether order would trade against the book as soon as it
+// was placed
+func (m *Matcher) WouldCross(tx *sql.Tx, order *types.Order) (bool, error) {
+	levels, err := m.orderRepo.GetBookLevels(tx, order.TokenID, oppositeSide(order.OrderType), 1)
+	if err != nil || len(levels) == 0 {
+		return false, err
+	}
+	return crosses(order, levels[0].Price), nil
+}
+
+// CheckReduceOnly ensures a reduce-only sell, together with the user's stop
+// sells still waiting for their trigger, sells no more than the user's free
+// balance. Sells on the book already have their tokens reserved.
+func (m *Matcher) CheckReduceOnly(tx *sql.Tx, order *types.Order) error {
+	return m.checkSellable(tx, order, order.RemainingAmount)
+}
+
+func (m *Matcher) checkSellable(tx *sql.Tx, order *types.Order, amount *big.Int) error {
+	balance, err := m.tokenRepo.GetTokenBalance(tx, order.UserID, order.TokenID)
+	if err != nil {
+		return err
+	}
+
+	selling, err := m.orderRepo.GetPendingSellAmount(tx, order.UserID, order.TokenID)
+	if err != nil {
+		return err
+	}
+
+	selling.Add(selling, amount)
+	if selling.Cmp(balance) > 0 {
+		return fmt.Errorf("reduce-only order would sell more tokens than are held")
+	}
+	return nil
+}
+
+// LockOrder takes the book lock for an order's token and returns the order as
+// it stands once the lock is held
+func (m *Matcher) LockOrder(tx *sql.Tx, orderID uint) (*types.Order, error) {
+	order, err := m.orderRepo.GetOrderByID(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.orderRepo.LockOrderBook(tx, order.TokenID); err != nil {
+		return nil, err
+	}
+
+	return m.orderRepo.GetOrderByID(tx, orderID)
+}
+
+// PriceMarketOrder sets a market order's price to the worst it may fill at:
+// the best opposite price moved against the order by slippageBps. Buys reserve
+// cash at that price, and Match stops once the book moves past it.
+func (m *Matcher) PriceMarketOrder(tx *sql.Tx, order *types.Order, slippageBps int64) error {
+	side := oppositeSide(order.OrderType)
+	levels, err := m.orderRepo.GetBookLevels(tx, order.TokenID, side, 1)
+	if err != nil {
+		return err
+	}
+	if len(levels) == 0 {
+		return fmt.Errorf("%w on the %s side", errNoLiquidity, side)
+	}
+
+	best := levels[0].Price
+	if order.OrderType == "buy" {
+		order.Price = new(big.Int).Mul(best, big.NewInt(basisPoints+slippageBps))
+		order.Price.Quo(order.Price, big.NewInt(basisPoints))
+	} else {
+		// rounded up so that rounding never widens the protection
+		order.Price = new(big.Int).Mul(best, big.NewInt(basisPoints-slippageBps))
+		order.Price.Add(order.Price, big.NewInt(basisPoints-1))
+		order.Price.Quo(order.Price, big.NewInt(basisPoints))
+	}
+	return nil
+}
+
+// CancelRemaining hands back what is still reserved for an order and cancels
+// it, along with the other order of its one-cancels-other pair. Whatever was
+// already filled stays filled.
+func (m *Matcher) CancelRemaining(tx *sql.Tx, order *types.Order) error {
+	if err := m.cancel(tx, order); err != nil {
+		return err
+	}
+	return m.cancelLinked(tx, order)
+}
+
+func (m *Matcher) cancel(tx *sql.Tx, order *types.Order) error {
+	// stop orders reserve nothing until they trigger
+	if order.Status != "pending_trigger" {
+		if err := m.Release(tx, order); err != nil {
+			return err
+		}
+	}
+
+	order.Status = "cancelled"
+	return m.orderRepo.UpdateOrderStatus(tx, order.ID, order.Status)
+}
+
+// cancelLinked cancels the other order of the one-cancels-other pair that
+// order is in, if it is in one and the other order is still working. Callers
+// use it once order has traded, triggered or been cancelled.
+func (m *Matcher) cancelLinked(tx *sql.Tx, order *types.Order) error {
+	linkedID, err := m.orderRepo.GetLinkedOrderID(tx, order.ID)
+	if err != nil || linkedID == 0 {
+		return err
+	}
+
+	linked, err := m.orderRepo.GetOrderByID(tx, linkedID)
+	if err != nil || !isWorking(linked) {
+		return err
+	}
+	return m.cancel(tx, linked)
+}
+
+// preventSelfTrade stops taker from trading with maker, an order of the same
+// user, the way the taker's self-trade prevention mode says: by cancelling the
+// taker, the maker or both, or by taking the amount they would have traded
+// off both without a trade
+func (m *Matcher) preventSelfTrade(tx *sql.Tx, taker, maker *types.Order) error {
+	switch taker.SelfTradePrevention {
+	case "cancel_oldest":
+		return m.CancelRemaining(tx, maker)
+	case "cancel_both":
+		if err := m.CancelRemaining(tx, maker); err != nil {
+			return err
+		}
+		return m.CancelRemaining(tx, taker)
+	case "decrement":
+		quantity := minAmount(taker.RemainingAmount, maker.RemainingAmount)
+		if err := m.decrement(tx, maker, quantity); err != nil {
+			return err
+		}
+		return m.decrement(tx, taker, quantity)
+	}
+	return m.CancelRemaining(tx, taker)
+}
+
+// decrement takes quantity off an order without trading it, handing back what
+// was reserved for it, and cancels the order once nothing is left
+func (m *Matcher) decrement(tx *sql.Tx, order *types.Order, quantity *big.Int) error {
+	reserved := reservation(order)
+	order.Amount = new(big.Int).Sub(order.Amount, quantity)
+	order.RemainingAmount = new(big.Int).Sub(order.RemainingAmount, quantity)
+	if order.DisplayAmount != nil {
+		order.VisibleAmount = minAmount(order.VisibleAmount, order.RemainingAmount)
+	}
+
+	if err := m.reserve(tx, order, new(big.Int).Sub(reservation(order), reserved)); err != nil {
+		return err
+	}
+
+	if err := m.orderRepo.AmendOrder(tx, order); err != nil {
+		return err
+	}
+
+	if order.RemainingAmount.Sign() > 0 {
+		return nil
+	}
+	order.Status = "cancelled"
+	if err := m.orderRepo.UpdateOrderStatus(tx, order.ID, order.Status); err != nil {
+		return err
+	}
+	return m.cancelLinked(tx, order)
+}
+
+// fill settles one trade between taker and maker at price and persists the
+// maker's new fill state. The taker is only updated in memory. aggressorSide
+// is recorded on the trade, and left empty when neither side took liquidity.
+func (m *Matcher) fill(tx *sql.Tx, taker, maker *types.Order, quantity, price *big.Int, aggressorSide string) (*types.Trade, error) {
+	buyer, seller := taker, maker
+	if taker.OrderType == "sell" {
+		buyer, seller = maker, taker
+	}
+
+	// both sides were reserved when the orders were placed: the seller's
+	// tokens and the buyer's cash at their limit price, so the seller is paid
+	// and the buyer gets back whatever they reserved above the trade price
+	if err := m.addTokens(tx, buyer.UserID, taker.TokenID, quantity); err != nil {
+		return nil, err
+	}
+	if err := m.addCash(tx, seller.UserID, notional(price, quantity)); err != nil {
+		return nil, err
+	}
+	if improvement := new(big.Int).Sub(buyer.Price, price); improvement.Sign() > 0 {
+		if err := m.addCash(tx, buyer.UserID, notional(improvement, quantity)); err != nil {
+			return nil, err
+		}
+	}
+
+	trade := &types.Trade{
+		SellerID:      seller.UserID,
+		BuyerID:       buyer.UserID,
+		BuyOrderID:    buyer.ID,
+		SellOrderID:   seller.ID,
+		TokenID:       taker.TokenID,
+		Amount:        quantity,
+		Price:         price,
+		AggressorSide: aggressorSide,
+	}
+	if err := m.orderRepo.CreateTrade(tx, trade); err != nil {
+		return nil, err
+	}
+
+	applyFill(taker, quantity)
+	applyFill(maker, quantity)
+	requeue := drawVisible(maker, quantity)
+	if err := m.orderRepo.UpdateOrderFill(tx, maker); err != nil {
+		return nil, err
+	}
+	if requeue {
+		if err := m.orderRepo.RequeueOrder(tx, maker.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.cancelLinked(tx, maker); err != nil {
+		return nil, err
+	}
+
+	return trade, nil
+}
+
+// reserve takes amount more out of the balance an order spends from, or hands
+// back -amount
+func (m *Matcher) reserve(tx *sql.Tx, order *types.Order, amount *big.Int) error {
+	if order.OrderType == "sell" {
+		return m.addTokens(tx, order.UserID, order.TokenID, new(big.Int).Neg(amount))
+	}
+	return m.addCash(tx, order.UserID, new(big.Int).Neg(amount))
+}
+
+func (m *Matcher) addTokens(tx *sql.Tx, userID, tokenID uint, delta *big.Int) error {
+	balance, err := m.tokenRepo.GetTokenBalance(tx, userID, tokenID)
+	if err != nil {
+		return err
+	}
+
+	balance.Add(balance, delta)
+	if balance.Sign() < 0 {
+		return errInsufficientBalance
+	}
+
+	return m.tokenRepo.UpdateTokenBalance(tx, userID, tokenID, balance)
+}
+
+func (m *Matcher) addCash(tx *sql.Tx, userID uint, delta *big.Int) error {
+	balance, err := m.tokenRepo.GetCashBalance(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	balance.Add(balance, delta)
+	if balance.Sign() < 0 {
+		return errInsufficientFunds
+	}
+
+	return m.tokenRepo.UpdateCashBalance(tx, userID, balance)
+}
+
+func applyFill(order *types.Order, quantity *big.Int) {
+	order.FilledAmount = new(big.Int).Add(order.FilledAmount, quantity)
+	order.RemainingAmount = new(big.Int).Sub(order.Amount, order.FilledAmount)
+	if order.RemainingAmount.Sign() == 0 {
+		order.Status = "filled"
+	} else {
+		order.Status = "partially_filled"
+	}
+}
+
+// drawVisible takes quantity off the visible slice of an iceberg order and, once
+// the slice runs out, shows the next one from the hidden amount. It reports
+// whether a new slice was shown.
+func drawVisible(order *types.Order, quantity *big.Int) bool {
+	if order.DisplayAmount == nil {
+		return false
+	}
+
+	order.VisibleAmount = new(big.Int).Sub(order.VisibleAmount, quantity)
+	if order.VisibleAmount.Sign() > 0 || order.RemainingAmount.Sign() == 0 {
+		return false
+	}
+
+	order.VisibleAmount = minAmount(order.DisplayAmount, order.RemainingAmount)
+	return true
+}
+
+// displayed is how much of an order the book shows: the visible slice of an
+// iceberg order, or all that remains of any other order
+func displayed(order *types.Order) *big.Int {
+	if order.DisplayAmount != nil {
+		return order.VisibleAmount
+	}
+	return order.RemainingAmount
+}
+
+func isOpen(order *types.Order) bool {
+	return order.Status == "open" || order.Status == "partially_filled"
+}
+
+// isWorking reports whether an order can still be cancelled: it is either on
+// the book or waiting for its trigger
+func isWorking(order *types.Order) bool {
+	return isOpen(order) || order.Status == "pending_trigger"
+}
+
+func isExpired(order *types.Order) bool {
+	return order.ExpiresAt != nil && !order.ExpiresAt.After(time.Now())
+}
+
+func crosses(taker *types.Order, makerPrice *big.Int) bool {
+	if taker.OrderType == "buy" {
+		return makerPrice.Cmp(taker.Price) <= 0
+	}
+	return makerPrice.Cmp(taker.Price) >= 0
+}
+
+func oppositeSide(orderType string) string {
+	if orderType == "buy" {
+		return "sell"
+	}
+	return "buy"
+}
+
+// reservation is what is held back for an order's remaining amount
+func reservation(order *types.Order) *big.Int {
+	if order.OrderType == "sell" {
+		return order.RemainingAmount
+	}
+	return notional(order.Price, order.RemainingAmount)
+}
+
+func notional(price, quantity *big.Int) *big.Int {
+	return new(big.Int).Mul(price, quantity)
+}
+
+func minAmount(a, b *big.Int) *big.Int {
+	if a.Cmp(b) <= 0 {
+		return new(big.Int).Set(a)
+	}
+	return new(big.Int).Set(b)
+}
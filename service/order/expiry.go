@@ -0,0 +1,100 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/dawumnam/token-trader/db"
+	"github.com/dawumnam/token-trader/types"
+)
+
+const (
+	expirySweepInterval  = time.Second
+	expirySweepBatchSize = 100
+)
+
+// ExpirySweeper cancels GTD orders once they expire and hands back whatever
+// they still had reserved. Expired orders stop matching or triggering as soon
+// as they expire; the sweeper only releases their reservations.
+type ExpirySweeper struct {
+	orderRepo types.OrderRepository
+	txManager *db.TxManager
+	matcher   *Matcher
+}
+
+func NewExpirySweeper(orderRepo types.OrderRepository, tokenRepo types.TokenRepository, txManager *db.TxManager) *ExpirySweeper {
+	return &ExpirySweeper{
+		orderRepo: orderRepo,
+		txManager: txManager,
+		matcher:   NewMatcher(orderRepo, tokenRepo),
+	}
+}
+
+// Run sweeps once per interval until ctx is cancelled
+func (s *ExpirySweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sweep(ctx); err != nil {
+			log.Printf("expiry sweep failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep cancels every order that has expired so far
+func (s *ExpirySweeper) Sweep(ctx context.Context) error {
+	for {
+		var orders []*types.Order
+		err := s.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+			var err error
+			orders, err = s.orderRepo.GetExpiredOrders(tx, expirySweepBatchSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, order := range orders {
+			if err := s.expire(ctx, order.ID); err != nil {
+				return err
+			}
+		}
+
+		if len(orders) < expirySweepBatchSize || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *ExpirySweeper) expire(ctx context.Context, orderID uint) error {
+	var tokenID uint
+	err := s.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+		order, err := s.matcher.LockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		tokenID = order.TokenID
+
+		// the order may have been filled or cancelled since it was listed
+		if !isWorking(order) || !isExpired(order) {
+			return nil
+		}
+
+		return s.matcher.CancelRemaining(tx, order)
+	})
+	if err != nil {
+		return err
+	}
+
+	invalidateBook(tokenID)
+	return nil
+}
@@ -0,0 +1,54 @@
+package order
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dawumnam/token-trader/config"
+)
+
+// CheckTrading fails if trading on the token is halted
+func (m *Matcher) CheckTrading(tx *sql.Tx, tokenID uint) error {
+	status, err := m.orderRepo.GetTradingStatus(tx, tokenID)
+	if err != nil {
+		return err
+	}
+	if status.Halted {
+		return fmt.Errorf("trading is halted: %s", status.Reason)
+	}
+	return nil
+}
+
+// CheckCircuitBreaker halts trading on the token for the configured cooldown
+// once its price has moved more than the configured percentage within the
+// configured window. The trades that moved it stand. Callers must hold the
+// book lock for the token.
+func (m *Matcher) CheckCircuitBreaker(tx *sql.Tx, tokenID uint) error {
+	percent := config.Envs.CircuitBreakerPercent
+	if percent <= 0 {
+		return nil
+	}
+
+	window := time.Duration(config.Envs.CircuitBreakerWindow) * time.Second
+	low, high, err := m.orderRepo.GetTradePriceRange(tx, tokenID, window)
+	if err != nil || low == nil || low.Sign() <= 0 {
+		return err
+	}
+
+	// high - low > low * percent / 100
+	move := new(big.Int).Mul(new(big.Int).Sub(high, low), big.NewInt(100))
+	if move.Cmp(new(big.Int).Mul(low, big.NewInt(percent))) <= 0 {
+		return nil
+	}
+
+	status, err := m.orderRepo.GetTradingStatus(tx, tokenID)
+	if err != nil || status.Halted {
+		return err
+	}
+
+	reason := fmt.Sprintf("price moved more than %d%% within %s", percent, window)
+	cooldown := time.Duration(config.Envs.CircuitBreakerCooldown) * time.Second
+	return m.orderRepo.HaltTrading(tx, tokenID, reason, cooldown)
+}
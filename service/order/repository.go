@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"math/big"
+	"strings"
+	"time"
 
 	"github.com/dawumnam/token-trader/types"
 )
@@ -17,8 +19,13 @@ func NewOrderRepository(db *sql.DB) *OrderRepository {
 }
 
 func (r *OrderRepository) CreateOrder(tx *sql.Tx, order *types.Order) error {
-	query := `INSERT INTO orders (userID, tokenID, orderType, amount, price, status) VALUES (?, ?, ?, ?, ?, ?)`
-	result, err := tx.Exec(query, order.UserID, order.TokenID, order.OrderType, order.Amount.String(), order.Price.String(), order.Status)
+	query := `INSERT INTO orders (userID, tokenID, orderType, kind, timeInForce, amount, filledAmount, price, triggerPrice, status, expiresAt,
+                                  postOnly, reduceOnly, displayAmount, visibleAmount, selfTradePrevention, clientOrderId)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, order.UserID, order.TokenID, order.OrderType, order.Kind, order.TimeInForce,
+		order.Amount.String(), order.FilledAmount.String(), order.Price.String(), nullableAmount(order.TriggerPrice), order.Status, order.ExpiresAt,
+		order.PostOnly, order.ReduceOnly, nullableAmount(order.DisplayAmount), nullableAmount(order.VisibleAmount), order.SelfTradePrevention,
+		nullableString(order.ClientOrderID))
 	if err != nil {
 		return fmt.Errorf("error creating order: %w", err)
 	}
@@ -32,13 +39,48 @@ func (r *OrderRepository) CreateOrder(tx *sql.Tx, order *types.Order) error {
 	return nil
 }
 
-func (r *OrderRepository) GetOrderByID(tx *sql.Tx, id uint) (*types.Order, error) {
-	query := `SELECT id, userID, tokenID, orderType, amount, price, status, createdAt FROM orders WHERE id = ?`
+const orderColumns = `id, userID, tokenID, orderType, kind, timeInForce, amount, filledAmount, price, triggerPrice, status, expiresAt, postOnly, reduceOnly, displayAmount, visibleAmount, selfTradePrevention, clientOrderId, createdAt`
+
+// liveOrder matches orders that can still trade. GTD orders stop trading as
+// soon as they expire, whether or not the sweeper has cancelled them yet.
+const liveOrder = `status IN ('open', 'partially_filled') AND (expiresAt IS NULL OR expiresAt > ?)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanOrder(row rowScanner) (*types.Order, error) {
 	var order types.Order
-	var amountStr, priceStr string
-	err := tx.QueryRow(query, id).Scan(
-		&order.ID, &order.UserID, &order.TokenID, &order.OrderType, &amountStr, &priceStr, &order.Status, &order.CreatedAt,
-	)
+	var amountStr, filledStr, priceStr string
+	var triggerPrice, displayAmount, visibleAmount, clientOrderID sql.NullString
+	var expiresAt sql.NullTime
+	err := row.Scan(&order.ID, &order.UserID, &order.TokenID, &order.OrderType, &order.Kind, &order.TimeInForce,
+		&amountStr, &filledStr, &priceStr, &triggerPrice, &order.Status, &expiresAt, &order.PostOnly, &order.ReduceOnly,
+		&displayAmount, &visibleAmount, &order.SelfTradePrevention, &clientOrderID, &order.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	order.ClientOrderID = clientOrderID.String
+	order.TriggerPrice = scanAmount(triggerPrice)
+	order.DisplayAmount = scanAmount(displayAmount)
+	order.VisibleAmount = scanAmount(visibleAmount)
+
+	if expiresAt.Valid {
+		order.ExpiresAt = &expiresAt.Time
+	}
+
+	order.Amount, _ = new(big.Int).SetString(amountStr, 10)
+	order.FilledAmount, _ = new(big.Int).SetString(filledStr, 10)
+	order.Price, _ = new(big.Int).SetString(priceStr, 10)
+	order.RemainingAmount = new(big.Int).Sub(order.Amount, order.FilledAmount)
+
+	return &order, nil
+}
+
+func (r *OrderRepository) GetOrderByID(tx *sql.Tx, id uint) (*types.Order, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE id = ?`
+	order, err := scanOrder(tx.QueryRow(query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("order not found")
@@ -46,34 +88,201 @@ func (r *OrderRepository) GetOrderByID(tx *sql.Tx, id uint) (*types.Order, error
 		return nil, fmt.Errorf("error getting order: %w", err)
 	}
 
-	order.Amount, _ = new(big.Int).SetString(amountStr, 10)
-	order.Price, _ = new(big.Int).SetString(priceStr, 10)
+	return order, nil
+}
 
-	return &order, nil
+// GetOrderByClientID returns the user's order with the given client order ID,
+// or nil if there is none
+func (r *OrderRepository) GetOrderByClientID(tx *sql.Tx, userID uint, clientOrderID string) (*types.Order, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE userID = ? AND clientOrderId = ?`
+	order, err := scanOrder(tx.QueryRow(query, userID, clientOrderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting order: %w", err)
+	}
+
+	return order, nil
 }
 
 func (r *OrderRepository) GetOpenOrders(tx *sql.Tx, tokenID uint, orderType string) ([]*types.Order, error) {
-	query := `SELECT id, userID, tokenID, orderType, amount, price, status, createdAt 
+	query := `SELECT ` + orderColumns + `
               FROM orders 
-              WHERE tokenID = ? AND orderType = ? AND status = 'open'
-              ORDER BY price ASC, createdAt ASC`
-	rows, err := tx.Query(query, tokenID, orderType)
+              WHERE tokenID = ? AND orderType = ? AND ` + liveOrder + `
+              ORDER BY CASE WHEN orderType = 'buy' THEN price END DESC,
+                       CASE WHEN orderType = 'sell' THEN price END ASC,
+                       priorityAt ASC, id ASC`
+	return r.queryOrders(tx, query, tokenID, orderType, time.Now())
+}
+
+// GetExpiredOrders returns GTD orders that have expired but are still open or
+// waiting for their trigger, oldest expiry first
+func (r *OrderRepository) GetExpiredOrders(tx *sql.Tx, limit int) ([]*types.Order, error) {
+	query := `SELECT ` + orderColumns + `
+              FROM orders
+              WHERE timeInForce = 'GTD' AND status IN ('pending_trigger', 'open', 'partially_filled') AND expiresAt <= ?
+              ORDER BY expiresAt ASC, id ASC
+              LIMIT ?`
+	return r.queryOrders(tx, query, time.Now(), limit)
+}
+
+// GetWorkingOrders returns a user's orders that are on the book or waiting for
+// their trigger, optionally only those of one token (tokenID > 0) and/or side
+func (r *OrderRepository) GetWorkingOrders(tx *sql.Tx, userID, tokenID uint, orderType string) ([]*types.Order, error) {
+	query := `SELECT ` + orderColumns + `
+              FROM orders
+              WHERE userID = ? AND status IN ('pending_trigger', 'open', 'partially_filled')`
+	args := []any{userID}
+	if tokenID > 0 {
+		query += ` AND tokenID = ?`
+		args = append(args, tokenID)
+	}
+	if orderType != "" {
+		query += ` AND orderType = ?`
+		args = append(args, orderType)
+	}
+	query += ` ORDER BY tokenID ASC, id ASC`
+	return r.queryOrders(tx, query, args...)
+}
+
+// GetUserOrders returns the user's orders that pass the filter, newest first
+func (r *OrderRepository) GetUserOrders(tx *sql.Tx, userID uint, filter types.OrderFilter) ([]*types.Order, error) {
+	query := `SELECT ` + orderColumns + `
+              FROM orders
+              WHERE userID = ?`
+	args := []any{userID}
+	if filter.TokenID > 0 {
+		query += ` AND tokenID = ?`
+		args = append(args, filter.TokenID)
+	}
+	if len(filter.Statuses) > 0 {
+		query += ` AND status IN (?` + strings.Repeat(`, ?`, len(filter.Statuses)-1) + `)`
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	if filter.From != nil {
+		query += ` AND createdAt >= ?`
+		args = append(args, *filter.From)
+	}
+	if filter.To != nil {
+		query += ` AND createdAt < ?`
+		args = append(args, *filter.To)
+	}
+	if filter.BeforeID > 0 {
+		query += ` AND id < ?`
+		args = append(args, filter.BeforeID)
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+	return r.queryOrders(tx, query, args...)
+}
+
+// GetFillSummaries sums up the trades of each of the orders, keyed by order ID.
+// Orders that have not traded get an empty summary.
+func (r *OrderRepository) GetFillSummaries(tx *sql.Tx, orderIDs []uint) (map[uint]*types.FillSummary, error) {
+	summaries := make(map[uint]*types.FillSummary, len(orderIDs))
+	if len(orderIDs) == 0 {
+		return summaries, nil
+	}
+
+	args := make([]any, 0, 2*len(orderIDs))
+	for _, id := range orderIDs {
+		summaries[id] = &types.FillSummary{Notional: big.NewInt(0)}
+		args = append(args, id)
+	}
+	args = append(args, args...)
+
+	placeholders := `?` + strings.Repeat(`, ?`, len(orderIDs)-1)
+	query := `SELECT buyOrderID, sellOrderID, amount, price, createdAt
+              FROM trades
+              WHERE buyOrderID IN (` + placeholders + `) OR sellOrderID IN (` + placeholders + `)`
+	rows, err := tx.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error getting open orders: %w", err)
+		return nil, fmt.Errorf("error getting order fills: %w", err)
 	}
 	defer rows.Close()
 
-	var orders []*types.Order
+	filled := make(map[uint]*big.Int)
 	for rows.Next() {
-		var order types.Order
+		var buyOrderID, sellOrderID sql.NullInt64
 		var amountStr, priceStr string
-		err := rows.Scan(&order.ID, &order.UserID, &order.TokenID, &order.OrderType, &amountStr, &priceStr, &order.Status, &order.CreatedAt)
+		var createdAt time.Time
+		if err := rows.Scan(&buyOrderID, &sellOrderID, &amountStr, &priceStr, &createdAt); err != nil {
+			return nil, fmt.Errorf("error scanning order fill: %w", err)
+		}
+		amount, _ := new(big.Int).SetString(amountStr, 10)
+		price, _ := new(big.Int).SetString(priceStr, 10)
+
+		for _, id := range []sql.NullInt64{buyOrderID, sellOrderID} {
+			summary, ok := summaries[uint(id.Int64)]
+			if !id.Valid || !ok {
+				continue
+			}
+			summary.TradeCount++
+			summary.Notional.Add(summary.Notional, new(big.Int).Mul(amount, price))
+			if summary.LastFillAt == nil || createdAt.After(*summary.LastFillAt) {
+				summary.LastFillAt = &createdAt
+			}
+			if filled[uint(id.Int64)] == nil {
+				filled[uint(id.Int64)] = big.NewInt(0)
+			}
+			filled[uint(id.Int64)].Add(filled[uint(id.Int64)], amount)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating order fills: %w", err)
+	}
+
+	for id, amount := range filled {
+		summaries[id].AveragePrice = new(big.Int).Quo(summaries[id].Notional, amount)
+	}
+	return summaries, nil
+}
+
+// GetTriggeredOrders returns the pending stop orders of a token whose trigger
+// lastPrice has reached, in the order they were placed
+func (r *OrderRepository) GetTriggeredOrders(tx *sql.Tx, tokenID uint, lastPrice *big.Int) ([]*types.Order, error) {
+	query := `SELECT ` + orderColumns + `
+              FROM orders
+              WHERE tokenID = ? AND status = 'pending_trigger'
+                AND ((orderType = 'buy' AND triggerPrice <= ?) OR (orderType = 'sell' AND triggerPrice >= ?))
+                AND (expiresAt IS NULL OR expiresAt > ?)
+              ORDER BY createdAt ASC, id ASC`
+	return r.queryOrders(tx, query, tokenID, lastPrice.String(), lastPrice.String(), time.Now())
+}
+
+// ActivateOrder stores the kind, amount, price and status a stop order takes
+// on once it is triggered. It joins the queue at its price as of now.
+func (r *OrderRepository) ActivateOrder(tx *sql.Tx, order *types.Order) error {
+	query := `UPDATE orders SET kind = ?, amount = ?, visibleAmount = ?, price = ?, status = ?, priorityAt = CURRENT_TIMESTAMP(6)
+              WHERE id = ?`
+	_, err := tx.Exec(query, order.Kind, order.Amount.String(), nullableAmount(order.VisibleAmount), order.Price.String(), order.Status, order.ID)
+	if err != nil {
+		return fmt.Errorf("error activating order: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepository) queryOrders(tx *sql.Tx, query string, args ...any) ([]*types.Order, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []*types.Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning order: %w", err)
 		}
-		order.Amount, _ = new(big.Int).SetString(amountStr, 10)
-		order.Price, _ = new(big.Int).SetString(priceStr, 10)
-		orders = append(orders, &order)
+		orders = append(orders, order)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -92,9 +301,122 @@ func (r *OrderRepository) UpdateOrderStatus(tx *sql.Tx, orderID uint, status str
 	return nil
 }
 
+func (r *OrderRepository) UpdateOrderFill(tx *sql.Tx, order *types.Order) error {
+	query := `UPDATE orders SET filledAmount = ?, visibleAmount = ?, status = ? WHERE id = ?`
+	_, err := tx.Exec(query, order.FilledAmount.String(), nullableAmount(order.VisibleAmount), order.Status, order.ID)
+	if err != nil {
+		return fmt.Errorf("error updating order fill: %w", err)
+	}
+	return nil
+}
+
+func (r *OrderRepository) AmendOrder(tx *sql.Tx, order *types.Order) error {
+	query := `UPDATE orders SET amount = ?, price = ?, visibleAmount = ? WHERE id = ?`
+	_, err := tx.Exec(query, order.Amount.String(), order.Price.String(), nullableAmount(order.VisibleAmount), order.ID)
+	if err != nil {
+		return fmt.Errorf("error amending order: %w", err)
+	}
+	return nil
+}
+
+// RequeueOrder sends an order to the back of the queue at its price, as when
+// an iceberg order shows a new slice
+func (r *OrderRepository) RequeueOrder(tx *sql.Tx, orderID uint) error {
+	_, err := tx.Exec(`UPDATE orders SET priorityAt = CURRENT_TIMESTAMP(6) WHERE id = ?`, orderID)
+	if err != nil {
+		return fmt.Errorf("error requeueing order: %w", err)
+	}
+	return nil
+}
+
+// LinkOrders pairs two orders so that each can find the other
+func (r *OrderRepository) LinkOrders(tx *sql.Tx, orderID, linkedOrderID uint) error {
+	query := `INSERT INTO order_links (orderID, linkedOrderID) VALUES (?, ?), (?, ?)`
+	if _, err := tx.Exec(query, orderID, linkedOrderID, linkedOrderID, orderID); err != nil {
+		return fmt.Errorf("error linking orders: %w", err)
+	}
+	return nil
+}
+
+// GetLinkedOrderID returns the ID of the order linked to an order, or 0 if it
+// is not linked
+func (r *OrderRepository) GetLinkedOrderID(tx *sql.Tx, orderID uint) (uint, error) {
+	var linkedOrderID uint
+	err := tx.QueryRow(`SELECT linkedOrderID FROM order_links WHERE orderID = ?`, orderID).Scan(&linkedOrderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error getting linked order: %w", err)
+	}
+	return linkedOrderID, nil
+}
+
+// LockOrderBook takes a row lock on the token so that only one transaction at
+// a time can change its book
+func (r *OrderRepository) LockOrderBook(tx *sql.Tx, tokenID uint) error {
+	var id uint
+	err := tx.QueryRow(`SELECT id FROM tokens WHERE id = ? FOR UPDATE`, tokenID).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("token not found")
+		}
+		return fmt.Errorf("error locking order book: %w", err)
+	}
+	return nil
+}
+
+// GetBookLevels aggregates the open orders on one side of a book by price, best
+// price first, returning at most depth levels. Only the visible part of
+// iceberg orders is counted.
+func (r *OrderRepository) GetBookLevels(tx *sql.Tx, tokenID uint, orderType string, depth int) ([]*types.PriceLevel, error) {
+	order := "ASC"
+	if orderType == "buy" {
+		order = "DESC"
+	}
+	query := `SELECT price, SUM(COALESCE(visibleAmount, amount - filledAmount)), COUNT(*)
+              FROM orders
+              WHERE tokenID = ? AND orderType = ? AND ` + liveOrder + `
+              GROUP BY price
+              ORDER BY price ` + order + `
+              LIMIT ?`
+	rows, err := tx.Query(query, tokenID, orderType, time.Now(), depth)
+	if err != nil {
+		return nil, fmt.Errorf("error getting book levels: %w", err)
+	}
+	defer rows.Close()
+
+	levels := []*types.PriceLevel{}
+	for rows.Next() {
+		var level types.PriceLevel
+		var priceStr, quantityStr string
+		if err := rows.Scan(&priceStr, &quantityStr, &level.Orders); err != nil {
+			return nil, fmt.Errorf("error scanning book level: %w", err)
+		}
+		level.Price, _ = new(big.Int).SetString(priceStr, 10)
+		level.Quantity, _ = new(big.Int).SetString(quantityStr, 10)
+		levels = append(levels, &level)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating book levels: %w", err)
+	}
+
+	return levels, nil
+}
+
+// CreateTrade stores a trade as the token's next one in sequence. Trades are
+// only made under the token's book lock, so no two can take the same number.
 func (r *OrderRepository) CreateTrade(tx *sql.Tx, trade *types.Trade) error {
-	query := `INSERT INTO trades (sellerID, buyerID, tokenID, amount, price) VALUES (?, ?, ?, ?, ?)`
-	result, err := tx.Exec(query, trade.SellerID, trade.BuyerID, trade.TokenID, trade.Amount.String(), trade.Price.String())
+	err := tx.QueryRow(`SELECT COALESCE(MAX(sequence), 0) + 1 FROM trades WHERE tokenID = ?`, trade.TokenID).Scan(&trade.Sequence)
+	if err != nil {
+		return fmt.Errorf("error getting trade sequence: %w", err)
+	}
+
+	query := `INSERT INTO trades (sellerID, buyerID, buyOrderID, sellOrderID, tokenID, amount, price, aggressorSide, sequence)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, trade.SellerID, trade.BuyerID, nullableID(trade.BuyOrderID), nullableID(trade.SellOrderID), trade.TokenID,
+		trade.Amount.String(), trade.Price.String(), nullableString(trade.AggressorSide), trade.Sequence)
 	if err != nil {
 		return fmt.Errorf("error creating trade: %w", err)
 	}
@@ -108,27 +430,85 @@ func (r *OrderRepository) CreateTrade(tx *sql.Tx, trade *types.Trade) error {
 	return nil
 }
 
-func (r *OrderRepository) GetUserTrades(tx *sql.Tx, userID uint) ([]*types.Trade, error) {
-	query := `SELECT id, sellerID, buyerID, tokenID, amount, price, createdAt 
+// GetUserTrades returns the user's trades that pass the filter, newest first
+func (r *OrderRepository) GetUserTrades(tx *sql.Tx, userID uint, filter types.TradeFilter) ([]*types.Trade, error) {
+	query := `SELECT ` + tradeColumns + ` 
               FROM trades 
-              WHERE sellerID = ? OR buyerID = ?
-              ORDER BY createdAt DESC`
-	rows, err := tx.Query(query, userID, userID)
+              WHERE `
+	var args []any
+	switch filter.Side {
+	case "buy":
+		query += "buyerID = ?"
+		args = append(args, userID)
+	case "sell":
+		query += "sellerID = ?"
+		args = append(args, userID)
+	default:
+		query += "(sellerID = ? OR buyerID = ?)"
+		args = append(args, userID, userID)
+	}
+	if filter.TokenID != 0 {
+		query += " AND tokenID = ?"
+		args = append(args, filter.TokenID)
+	}
+	if filter.From != nil {
+		query += " AND createdAt >= ?"
+		args = append(args, *filter.From)
+	}
+	if filter.To != nil {
+		query += " AND createdAt < ?"
+		args = append(args, *filter.To)
+	}
+	if filter.BeforeID != 0 {
+		query += " AND id < ?"
+		args = append(args, filter.BeforeID)
+	}
+	// IDs grow with createdAt and also order trades made in the same second
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	return r.queryTrades(tx, query, args...)
+}
+
+// GetRecentTrades returns up to limit of the token's latest trades after the
+// one numbered afterSequence, newest first
+func (r *OrderRepository) GetRecentTrades(tx *sql.Tx, tokenID uint, afterSequence uint64, limit int) ([]*types.Trade, error) {
+	query := `SELECT ` + tradeColumns + `
+              FROM trades
+              WHERE tokenID = ? AND sequence > ?
+              ORDER BY sequence DESC
+              LIMIT ?`
+	return r.queryTrades(tx, query, tokenID, afterSequence, limit)
+}
+
+const tradeColumns = `id, sellerID, buyerID, buyOrderID, sellOrderID, tokenID, amount, price, createdAt, sequence, aggressorSide`
+
+func (r *OrderRepository) queryTrades(tx *sql.Tx, query string, args ...any) ([]*types.Trade, error) {
+	rows, err := tx.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error getting user trades: %w", err)
+		return nil, fmt.Errorf("error getting trades: %w", err)
 	}
 	defer rows.Close()
 
 	var trades []*types.Trade
 	for rows.Next() {
 		var trade types.Trade
+		var buyOrderID, sellOrderID sql.NullInt64
 		var amountStr, priceStr string
-		err := rows.Scan(&trade.ID, &trade.SellerID, &trade.BuyerID, &trade.TokenID, &amountStr, &priceStr, &trade.CreatedAt)
+		var aggressorSide sql.NullString
+		err := rows.Scan(&trade.ID, &trade.SellerID, &trade.BuyerID, &buyOrderID, &sellOrderID, &trade.TokenID, &amountStr, &priceStr, &trade.CreatedAt,
+			&trade.Sequence, &aggressorSide)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning trade: %w", err)
 		}
+		trade.BuyOrderID = uint(buyOrderID.Int64)
+		trade.SellOrderID = uint(sellOrderID.Int64)
 		trade.Amount, _ = new(big.Int).SetString(amountStr, 10)
 		trade.Price, _ = new(big.Int).SetString(priceStr, 10)
+		trade.AggressorSide = aggressorSide.String
 		trades = append(trades, &trade)
 	}
 
@@ -138,3 +518,132 @@ func (r *OrderRepository) GetUserTrades(tx *sql.Tx, userID uint) ([]*types.Trade
 
 	return trades, nil
 }
+
+// GetLastTradePrice returns the price of the token's most recent trade, or nil
+// if it has never traded
+func (r *OrderRepository) GetLastTradePrice(tx *sql.Tx, tokenID uint) (*big.Int, error) {
+	var priceStr string
+	err := tx.QueryRow(`SELECT price FROM trades WHERE tokenID = ? ORDER BY id DESC LIMIT 1`, tokenID).Scan(&priceStr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting last trade price: %w", err)
+	}
+
+	price, _ := new(big.Int).SetString(priceStr, 10)
+	return price, nil
+}
+
+// GetPendingSellAmount returns how much a user's stop sells of a token will
+// sell once they trigger. Unlike sells on the book, they have no tokens
+// reserved.
+func (r *OrderRepository) GetPendingSellAmount(tx *sql.Tx, userID, tokenID uint) (*big.Int, error) {
+	query := `SELECT COALESCE(SUM(amount - filledAmount), 0)
+              FROM orders
+              WHERE userID = ? AND tokenID = ? AND orderType = 'sell' AND status = 'pending_trigger'`
+	var amountStr string
+	if err := tx.QueryRow(query, userID, tokenID).Scan(&amountStr); err != nil {
+		return nil, fmt.Errorf("error getting pending sell amount: %w", err)
+	}
+
+	amount, _ := new(big.Int).SetString(amountStr, 10)
+	return amount, nil
+}
+
+// GetTradePriceRange returns the lowest and highest prices the token traded at
+// within the window, leaving out trades from before its last halt ended, or nil
+// if it has not traded since
+func (r *OrderRepository) GetTradePriceRange(tx *sql.Tx, tokenID uint, window time.Duration) (*big.Int, *big.Int, error) {
+	query := `SELECT MIN(t.price), MAX(t.price)
+              FROM trades t
+              LEFT JOIN trading_halts h ON h.tokenID = t.tokenID
+              WHERE t.tokenID = ? AND t.createdAt >= NOW() - INTERVAL ? SECOND
+              AND (h.resumesAt IS NULL OR t.createdAt >= h.resumesAt)`
+	var low, high sql.NullString
+	if err := tx.QueryRow(query, tokenID, int(window.Seconds())).Scan(&low, &high); err != nil {
+		return nil, nil, fmt.Errorf("error getting trade price range: %w", err)
+	}
+	return scanAmount(low), scanAmount(high), nil
+}
+
+// GetTradingStatus reports whether trading on the token is halted. Halts with
+// a resume time stop applying once it has passed.
+func (r *OrderRepository) GetTradingStatus(tx *sql.Tx, tokenID uint) (*types.TradingStatus, error) {
+	status := &types.TradingStatus{TokenID: tokenID}
+	query := `SELECT reason, haltedAt, resumesAt
+              FROM trading_halts
+              WHERE tokenID = ? AND (resumesAt IS NULL OR resumesAt > NOW())`
+	var haltedAt time.Time
+	var resumesAt sql.NullTime
+	err := tx.QueryRow(query, tokenID).Scan(&status.Reason, &haltedAt, &resumesAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return status, nil
+		}
+		return nil, fmt.Errorf("error getting trading status: %w", err)
+	}
+
+	status.Halted = true
+	status.HaltedAt = &haltedAt
+	if resumesAt.Valid {
+		status.ResumesAt = &resumesAt.Time
+	}
+	return status, nil
+}
+
+// HaltTrading halts trading on the token for duration, or until it is resumed
+// if duration is 0, replacing any halt already in place
+func (r *OrderRepository) HaltTrading(tx *sql.Tx, tokenID uint, reason string, duration time.Duration) error {
+	resumesAt := "NULL"
+	if duration > 0 {
+		resumesAt = fmt.Sprintf("NOW() + INTERVAL %d SECOND", int(duration.Seconds()))
+	}
+	query := `INSERT INTO trading_halts (tokenID, reason, haltedAt, resumesAt)
+              VALUES (?, ?, NOW(), ` + resumesAt + `)
+              ON DUPLICATE KEY UPDATE reason = VALUES(reason), haltedAt = VALUES(haltedAt), resumesAt = VALUES(resumesAt)`
+	if _, err := tx.Exec(query, tokenID, reason); err != nil {
+		return fmt.Errorf("error halting trading: %w", err)
+	}
+	return nil
+}
+
+// ResumeTrading ends the token's halt now. The halt is kept so that the price
+// moves that led to it do not trip the circuit breaker again.
+func (r *OrderRepository) ResumeTrading(tx *sql.Tx, tokenID uint) error {
+	query := `UPDATE trading_halts SET resumesAt = NOW()
+              WHERE tokenID = ? AND (resumesAt IS NULL OR resumesAt > NOW())`
+	if _, err := tx.Exec(query, tokenID); err != nil {
+		return fmt.Errorf("error resuming trading: %w", err)
+	}
+	return nil
+}
+
+func scanAmount(amount sql.NullString) *big.Int {
+	if !amount.Valid {
+		return nil
+	}
+	value, _ := new(big.Int).SetString(amount.String, 10)
+	return value
+}
+
+func nullableAmount(amount *big.Int) any {
+	if amount == nil {
+		return nil
+	}
+	return amount.String()
+}
+
+func nullableString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullableID(id uint) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
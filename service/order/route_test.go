@@ -2,22 +2,30 @@ package order
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/dawumnam/token-trader/config"
 	"github.com/dawumnam/token-trader/db"
 	"github.com/dawumnam/token-trader/service/token"
+	"github.com/dawumnam/token-trader/service/token/blockchain"
 	"github.com/dawumnam/token-trader/service/user"
+	"github.com/dawumnam/token-trader/service/user/auth"
 	"github.com/dawumnam/token-trader/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/go-sql-driver/mysql"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
@@ -26,6 +34,8 @@ var testDB *sql.DB
 var orderHandler *Handler
 var userHandler *user.Handler
 var tokenHandler *token.Handler
+var expirySweeper *ExpirySweeper
+var auctionRunner *AuctionRunner
 
 func TestMain(m *testing.M) {
 	cfg := config.Envs
@@ -48,16 +58,39 @@ func TestMain(m *testing.M) {
 	db.InitDatabase(testDB)
 	db.Init()
 
+	// a fresh key per run keeps contract addresses from colliding with the
+	// tokens that earlier runs left in the database
+	chainKey, err := crypto.GenerateKey()
+	if err != nil {
+		fmt.Printf("Failed to generate chain key: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.ChainBackend = "simulated"
+	cfg.ChainPrivateKey = hex.EncodeToString(crypto.FromECDSA(chainKey))
+	tokenManager, err := blockchain.NewTokenManager(cfg)
+	if err != nil {
+		fmt.Printf("Failed to start simulated chain: %v\n", err)
+		os.Exit(1)
+	}
+
 	orderRepo := NewOrderRepository(testDB)
 	tokenRepo := token.NewTokenRepository(testDB)
 	userRepo := user.NewRepository(testDB)
 	txManager := db.NewTxManager(testDB)
 
+	deployer := token.NewDeployer(tokenRepo, txManager, tokenManager)
+	ctx, stopDeployer := context.WithCancel(context.Background())
+	go deployer.Run(ctx)
+
 	orderHandler = NewHandler(orderRepo, tokenRepo, userRepo, txManager)
+	expirySweeper = NewExpirySweeper(orderRepo, tokenRepo, txManager)
+	auctionRunner = NewAuctionRunner(orderRepo, tokenRepo, txManager)
 	userHandler = user.NewHandler(userRepo)
-	tokenHandler = token.NewHandler(tokenRepo, userRepo, txManager)
+	tokenHandler = token.NewHandler(tokenRepo, userRepo, txManager, deployer)
 
 	code := m.Run()
+	stopDeployer()
+	tokenManager.Close()
 	testDB.Close()
 	os.Exit(code)
 }
@@ -128,12 +161,22 @@ func createTokenForUser(t *testing.T, token string) types.Token {
 		t.Fatalf("Failed to unmarshal response: %v", err)
 	}
 
+	// the initial supply is only credited once the contract is deployed
+	deadline := time.Now().Add(10 * time.Second)
+	for getBalance(t, token, response.ID) != payload.InitialSupply {
+		if time.Now().After(deadline) {
+			t.Fatalf("Token %d was not deployed in time", response.ID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
 	return response
 }
 
 func TestHandlePlaceOrder(t *testing.T) {
 	_, token := createRandomUser(t)
 	createdToken := createTokenForUser(t, token)
+	depositCash(t, token, "1000")
 
 	payload := types.PlaceOrderPayload{
 		TokenID:   createdToken.ID,
@@ -170,6 +213,7 @@ func TestHandlePlaceOrder(t *testing.T) {
 func TestHandleListOrders(t *testing.T) {
 	_, token := createRandomUser(t)
 	createdToken := createTokenForUser(t, token)
+	depositCash(t, token, "3000")
 
 	for i := 0; i < 2; i++ {
 		payload := types.PlaceOrderPayload{
@@ -220,6 +264,7 @@ func TestHandleListOrders(t *testing.T) {
 func TestHandleCancelOrder(t *testing.T) {
 	_, token := createRandomUser(t)
 	createdToken := createTokenForUser(t, token)
+	depositCash(t, token, "1000")
 
 	placePayload := types.PlaceOrderPayload{
 		TokenID:   createdToken.ID,
@@ -261,6 +306,9 @@ func TestHandleCancelOrder(t *testing.T) {
 		t.Errorf("Handler returned unexpected message: got %v want %v", message, "Order cancelled successfully")
 	}
 
+	if balance := getCashBalance(t, token); balance != "1000" {
+		t.Errorf("Unexpected cash balance after cancel: got %v want %v", balance, "1000")
+	}
 }
 
 func TestHandleExecuteOrder(t *testing.T) {
@@ -295,6 +343,7 @@ func TestHandleExecuteOrder(t *testing.T) {
 	}
 
 	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
 
 	executePayload := types.ExecuteOrderPayload{
 		OrderID: sellOrder.ID,
@@ -370,3 +419,1685 @@ func TestHandleExecuteOrder(t *testing.T) {
 		t.Errorf("Unexpected buyer balance: got %v want %v", buyerBalance.String(), "100")
 	}
 }
+
+func placeOrder(t *testing.T, token string, payload types.PlaceOrderPayload) types.PlaceOrderResponse {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", "/order/place", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("Failed to place order: got status %v, body %s", status, rr.Body.String())
+	}
+
+	var response types.PlaceOrderResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	return response
+}
+
+func listOrders(t *testing.T, token string, tokenID uint, orderType string) []*types.Order {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/order/list/%d?type=%s", tokenID, orderType), nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Failed to list orders: got status %v", status)
+	}
+
+	var orders []*types.Order
+	err := json.Unmarshal(rr.Body.Bytes(), &orders)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	return orders
+}
+
+func getBalance(t *testing.T, token string, tokenID uint) string {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/token/balance/%d", tokenID), nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	tokenHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Failed to get balance: got status %v", status)
+	}
+
+	var response map[string]string
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	return response["balance"]
+}
+
+// cashAdminToken belongs to the admin that depositCash credits users as
+var cashAdminToken string
+
+func depositCash(t *testing.T, token string, amount string) {
+	if cashAdminToken == "" {
+		var admin types.User
+		admin, cashAdminToken = createRandomUser(t)
+		if _, err := testDB.Exec("UPDATE users SET isAdmin = TRUE WHERE email = ?", admin.Email); err != nil {
+			t.Fatalf("Failed to make user an admin: %v", err)
+		}
+	}
+
+	parsed, err := auth.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	userID, _ := strconv.Atoi(parsed.Claims.(jwt.MapClaims)["userID"].(string))
+
+	body, _ := json.Marshal(types.DepositCashPayload{UserID: uint(userID), Amount: amount})
+	req, _ := http.NewRequest("POST", "/cash/deposit", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", cashAdminToken)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	tokenHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Failed to deposit cash: got status %v", status)
+	}
+}
+
+func getCashBalance(t *testing.T, token string) string {
+	req, _ := http.NewRequest("GET", "/cash/balance", nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	tokenHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Failed to get cash balance: got status %v", status)
+	}
+
+	var response map[string]string
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	return response["balance"]
+}
+
+func TestPlaceOrderMatchesRestingOrders(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "11"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "2000")
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "150", Price: "11"})
+
+	if response.Status != "filled" {
+		t.Errorf("Unexpected order status: got %v want %v", response.Status, "filled")
+	}
+
+	if len(response.Trades) != 2 {
+		t.Fatalf("Unexpected number of trades: got %v want %v", len(response.Trades), 2)
+	}
+
+	if response.Trades[0].Price.String() != "10" || response.Trades[0].Amount.String() != "100" {
+		t.Errorf("Unexpected first trade: %+v", response.Trades[0])
+	}
+
+	if response.Trades[1].Price.String() != "11" || response.Trades[1].Amount.String() != "50" {
+		t.Errorf("Unexpected second trade: %+v", response.Trades[1])
+	}
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "150" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "150")
+	}
+
+	if balance := getCashBalance(t, buyerToken); balance != "450" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "450")
+	}
+
+	if balance := getCashBalance(t, sellerToken); balance != "1550" {
+		t.Errorf("Unexpected seller cash balance: got %v want %v", balance, "1550")
+	}
+
+	sells := listOrders(t, sellerToken, createdToken.ID, "sell")
+	if len(sells) != 1 || sells[0].RemainingAmount.String() != "50" || sells[0].Price.String() != "11" || sells[0].Status != "partially_filled" {
+		t.Errorf("Unexpected resting sell orders: %+v", sells)
+	}
+}
+
+func TestPlaceOrderRestsWhenNotCrossing(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "12"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1100")
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "100", Price: "11"})
+
+	if response.Status != "open" || len(response.Trades) != 0 {
+		t.Errorf("Expected order to rest without trades: %+v", response)
+	}
+
+	buys := listOrders(t, buyerToken, createdToken.ID, "buy")
+	if len(buys) != 1 {
+		t.Errorf("Unexpected number of buy orders: got %v want %v", len(buys), 1)
+	}
+}
+
+func TestHandleExecuteOrderPartially(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	sellOrder := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+
+	for _, amount := range []string{"30", "50"} {
+		_, buyerToken := createRandomUser(t)
+		depositCash(t, buyerToken, "1000")
+
+		body, _ := json.Marshal(types.ExecuteOrderPayload{OrderID: sellOrder.ID, Amount: amount})
+		req, _ := http.NewRequest("POST", "/order/execute", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", buyerToken)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+
+		if balance := getBalance(t, buyerToken, createdToken.ID); balance != amount {
+			t.Errorf("Unexpected buyer balance: got %v want %v", balance, amount)
+		}
+	}
+
+	sells := listOrders(t, sellerToken, createdToken.ID, "sell")
+	if len(sells) != 1 || sells[0].FilledAmount.String() != "80" || sells[0].RemainingAmount.String() != "20" || sells[0].Status != "partially_filled" {
+		t.Errorf("Unexpected resting sell orders: %+v", sells)
+	}
+
+	if balance := getBalance(t, sellerToken, createdToken.ID); balance != "900" {
+		t.Errorf("Unexpected seller balance: got %v want %v", balance, "900")
+	}
+
+	if balance := getCashBalance(t, sellerToken); balance != "800" {
+		t.Errorf("Unexpected seller cash balance: got %v want %v", balance, "800")
+	}
+
+	_, buyerToken := createRandomUser(t)
+	body, _ := json.Marshal(types.ExecuteOrderPayload{OrderID: sellOrder.ID, Amount: "21"})
+	req, _ := http.NewRequest("POST", "/order/execute", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", buyerToken)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status == http.StatusOK {
+		t.Errorf("Expected executing more than the remaining amount to fail")
+	}
+}
+
+func TestPlaceBuyOrderRequiresFunds(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+	depositCash(t, token, "999")
+
+	body, _ := json.Marshal(types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "100", Price: "10"})
+	req, _ := http.NewRequest("POST", "/order/place", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status == http.StatusCreated {
+		t.Errorf("Expected buy order without enough cash to be rejected")
+	}
+
+	if balance := getCashBalance(t, token); balance != "999" {
+		t.Errorf("Unexpected cash balance: got %v want %v", balance, "999")
+	}
+}
+
+func getOrderBook(t *testing.T, tokenID uint, depth int) types.OrderBook {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/market/%d/book?depth=%d", tokenID, depth), nil)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Failed to get order book: got status %v", status)
+	}
+
+	var book types.OrderBook
+	err := json.Unmarshal(rr.Body.Bytes(), &book)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	return book
+}
+
+func TestHandleGetOrderBook(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "12"})
+	partial := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "50", Price: "12"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "13"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "20", Price: "10"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "5", Price: "9"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "30", Price: "10"})
+
+	book := getOrderBook(t, createdToken.ID, 10)
+
+	if len(book.Bids) != 2 || len(book.Asks) != 2 {
+		t.Fatalf("Unexpected number of levels: got %d bids and %d asks", len(book.Bids), len(book.Asks))
+	}
+
+	if book.Bids[0].Price.String() != "10" || book.Bids[0].Quantity.String() != "50" || book.Bids[0].Orders != 2 {
+		t.Errorf("Unexpected best bid: %+v", book.Bids[0])
+	}
+	if book.Bids[1].Price.String() != "9" || book.Bids[1].Quantity.String() != "5" || book.Bids[1].Orders != 1 {
+		t.Errorf("Unexpected second bid: %+v", book.Bids[1])
+	}
+	if book.Asks[0].Price.String() != "12" || book.Asks[0].Quantity.String() != "150" || book.Asks[0].Orders != 2 {
+		t.Errorf("Unexpected best ask: %+v", book.Asks[0])
+	}
+	if book.Asks[1].Price.String() != "13" || book.Asks[1].Quantity.String() != "10" || book.Asks[1].Orders != 1 {
+		t.Errorf("Unexpected second ask: %+v", book.Asks[1])
+	}
+
+	if book := getOrderBook(t, createdToken.ID, 1); len(book.Bids) != 1 || len(book.Asks) != 1 {
+		t.Errorf("Unexpected number of levels at depth 1: got %d bids and %d asks", len(book.Bids), len(book.Asks))
+	}
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/order/cancel/%d", partial.ID), nil)
+	req.Header.Set("Authorization", sellerToken)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Failed to cancel order: got status %v", status)
+	}
+
+	book = getOrderBook(t, createdToken.ID, 10)
+	if book.Asks[0].Quantity.String() != "100" || book.Asks[0].Orders != 1 {
+		t.Errorf("Cached book was not invalidated: %+v", book.Asks[0])
+	}
+}
+
+func tryPlaceOrder(t *testing.T, token string, payload types.PlaceOrderPayload) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", "/order/place", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestPlaceMarketOrderSweepsWithinSlippage(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "11"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "20"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "5000")
+	slippage := int64(1000)
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{
+		TokenID:        createdToken.ID,
+		OrderType:      "buy",
+		Kind:           "market",
+		Amount:         "250",
+		MaxSlippageBps: &slippage,
+	})
+
+	if len(response.Trades) != 2 {
+		t.Fatalf("Unexpected number of trades: got %v want %v", len(response.Trades), 2)
+	}
+
+	if response.Trades[0].Price.String() != "10" || response.Trades[1].Price.String() != "11" {
+		t.Errorf("Unexpected trade prices: %v and %v", response.Trades[0].Price, response.Trades[1].Price)
+	}
+
+	if response.Status != "cancelled" || response.FilledAmount.String() != "200" {
+		t.Errorf("Unexpected order state: status %v, filled %v", response.Status, response.FilledAmount)
+	}
+
+	if balance := getCashBalance(t, buyerToken); balance != "2900" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "2900")
+	}
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "200" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "200")
+	}
+}
+
+func TestPlaceMarketOrderRequiresLiquidity(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+
+	rr := tryPlaceOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Kind: "market", Amount: "10"})
+	if rr.Code == http.StatusCreated {
+		t.Errorf("Expected market order on an empty book to be rejected")
+	}
+
+	if balance := getBalance(t, token, createdToken.ID); balance != "1000" {
+		t.Errorf("Unexpected balance: got %v want %v", balance, "1000")
+	}
+}
+
+func TestPlaceIOCOrderCancelsRemainder(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "50", Price: "10"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "100", Price: "10", TimeInForce: "IOC"})
+
+	if response.Status != "cancelled" || response.FilledAmount.String() != "50" {
+		t.Errorf("Unexpected order state: status %v, filled %v", response.Status, response.FilledAmount)
+	}
+
+	if balance := getCashBalance(t, buyerToken); balance != "500" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "500")
+	}
+
+	if buys := listOrders(t, buyerToken, createdToken.ID, "buy"); len(buys) != 0 {
+		t.Errorf("Expected IOC remainder not to rest on the book, found %d orders", len(buys))
+	}
+}
+
+func TestPlaceFOKOrderFillsCompletelyOrNotAtAll(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "50", Price: "10"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+
+	rr := tryPlaceOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "100", Price: "10", TimeInForce: "FOK"})
+	if rr.Code == http.StatusCreated {
+		t.Fatalf("Expected FOK order larger than the book to be rejected")
+	}
+
+	if balance := getCashBalance(t, buyerToken); balance != "1000" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "1000")
+	}
+
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "50", Price: "10", TimeInForce: "FOK"})
+	if response.Status != "filled" {
+		t.Errorf("Unexpected order status: got %v want %v", response.Status, "filled")
+	}
+}
+
+func TestPlaceFOKOrderCountsSelfTradePrevention(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	depositCash(t, sellerToken, "1000")
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "11"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "50", Price: "10"})
+
+	// the seller's own bid is best, so matching would cancel the order there
+	// before anything traded
+	rr := tryPlaceOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "50", Price: "10", TimeInForce: "FOK"})
+	if rr.Code == http.StatusCreated {
+		t.Fatalf("Expected FOK order stopped by its own bid to be rejected")
+	}
+
+	if balance := getBalance(t, sellerToken, createdToken.ID); balance != "1000" {
+		t.Errorf("Unexpected seller balance: got %v want %v", balance, "1000")
+	}
+	if buys := listOrders(t, sellerToken, createdToken.ID, "buy"); len(buys) != 2 {
+		t.Errorf("Expected both bids to stay on the book, found %d orders", len(buys))
+	}
+
+	response := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "50", Price: "10", TimeInForce: "FOK", SelfTradePrevention: "cancel_oldest"})
+	if response.Status != "filled" {
+		t.Errorf("Unexpected order status: got %v want %v", response.Status, "filled")
+	}
+	if buys := listOrders(t, sellerToken, createdToken.ID, "buy"); len(buys) != 0 {
+		t.Errorf("Expected the own bid to be cancelled and the other filled, found %d orders", len(buys))
+	}
+}
+
+func TestPlaceGTDOrderRequiresExpiry(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+
+	rr := tryPlaceOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10", TimeInForce: "GTD"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExpirySweeperCancelsExpiredOrders(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+
+	expiresAt := time.Now().Add(time.Second)
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10", TimeInForce: "GTD", ExpiresAt: &expiresAt})
+
+	if balance := getBalance(t, token, createdToken.ID); balance != "900" {
+		t.Fatalf("Unexpected balance: got %v want %v", balance, "900")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	if sells := listOrders(t, token, createdToken.ID, "sell"); len(sells) != 0 {
+		t.Errorf("Expected expired order to leave the book, found %d orders", len(sells))
+	}
+
+	if err := expirySweeper.Sweep(context.Background()); err != nil {
+		t.Fatalf("Failed to sweep expired orders: %v", err)
+	}
+
+	if balance := getBalance(t, token, createdToken.ID); balance != "1000" {
+		t.Errorf("Unexpected balance after expiry: got %v want %v", balance, "1000")
+	}
+}
+
+func TestStopOrderTriggersOnLastTradePrice(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	stop := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Kind: "stop", Amount: "100", TriggerPrice: "9"})
+	if stop.Status != "pending_trigger" {
+		t.Fatalf("Unexpected stop order status: got %v want %v", stop.Status, "pending_trigger")
+	}
+
+	if balance := getBalance(t, sellerToken, createdToken.ID); balance != "1000" {
+		t.Errorf("Expected a pending stop order to reserve nothing, balance is %v", balance)
+	}
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "2000")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "100", Price: "8"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "9"})
+
+	// trading at the trigger price turns the stop into a market sell
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "9"})
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "110" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "110")
+	}
+
+	if balance := getBalance(t, sellerToken, createdToken.ID); balance != "890" {
+		t.Errorf("Unexpected seller balance: got %v want %v", balance, "890")
+	}
+
+	if buys := listOrders(t, buyerToken, createdToken.ID, "buy"); len(buys) != 0 {
+		t.Errorf("Expected the triggered stop to take every bid, found %d orders", len(buys))
+	}
+}
+
+func TestStopLimitOrderRestsAfterTriggering(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Kind: "stop_limit", Amount: "50", Price: "12", TriggerPrice: "10"})
+
+	if buys := listOrders(t, buyerToken, createdToken.ID, "buy"); len(buys) != 0 {
+		t.Fatalf("Expected a pending stop order to stay off the book, found %d orders", len(buys))
+	}
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "5", Price: "10"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "5", Price: "10"})
+
+	buys := listOrders(t, buyerToken, createdToken.ID, "buy")
+	if len(buys) != 1 || buys[0].Kind != "limit" || buys[0].Price.String() != "12" {
+		t.Fatalf("Expected the triggered stop to rest as a limit order at 12, got %+v", buys)
+	}
+
+	if balance := getCashBalance(t, buyerToken); balance != "350" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "350")
+	}
+}
+
+func TestStopOrderRequiresTriggerPrice(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+
+	rr := tryPlaceOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Kind: "stop", Amount: "10"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPlacePostOnlyOrderNeverTakesLiquidity(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+
+	rr := tryPlaceOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10", PostOnly: true})
+	if rr.Code == http.StatusCreated {
+		t.Fatalf("Expected crossing post-only order to be rejected")
+	}
+
+	if balance := getCashBalance(t, buyerToken); balance != "1000" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "1000")
+	}
+
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "9", PostOnly: true})
+	if response.Status != "open" || !response.PostOnly {
+		t.Errorf("Unexpected order state: status %v, postOnly %v", response.Status, response.PostOnly)
+	}
+}
+
+func TestReduceOnlySellCannotExceedHoldings(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Kind: "stop", Amount: "600", TriggerPrice: "5", ReduceOnly: true})
+
+	rr := tryPlaceOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "500", Price: "20", ReduceOnly: true})
+	if rr.Code == http.StatusCreated {
+		t.Fatalf("Expected reduce-only sell beyond the holdings to be rejected")
+	}
+
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "400", Price: "20", ReduceOnly: true})
+
+	rr = tryPlaceOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "1", ReduceOnly: true})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestIcebergOrderHidesReserve(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10", DisplayAmount: "20"})
+
+	_, buyerToken := createRandomUser(t)
+	sells := listOrders(t, buyerToken, createdToken.ID, "sell")
+	if len(sells) != 1 || sells[0].RemainingAmount.String() != "20" || sells[0].DisplayAmount != nil {
+		t.Fatalf("Expected other users to see only the visible slice, got %+v", sells)
+	}
+
+	if sells := listOrders(t, sellerToken, createdToken.ID, "sell"); sells[0].RemainingAmount.String() != "100" {
+		t.Errorf("Expected the owner to see the full remaining amount, got %v", sells[0].RemainingAmount)
+	}
+
+	depositCash(t, buyerToken, "1000")
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "50", Price: "10"})
+	if response.Status != "filled" || len(response.Trades) != 3 {
+		t.Fatalf("Unexpected order state: status %v, %d trades", response.Status, len(response.Trades))
+	}
+
+	book := getOrderBook(t, createdToken.ID, 5)
+	if len(book.Asks) != 1 || book.Asks[0].Quantity.String() != "10" {
+		t.Errorf("Expected the book to show only the visible slice, got %+v", book.Asks)
+	}
+}
+
+func TestIcebergOrderLosesPriorityOnReplenish(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	iceberg := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "40", Price: "10", DisplayAmount: "10"})
+	plain := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "20", Price: "10"})
+
+	if len(response.Trades) != 2 {
+		t.Fatalf("Unexpected number of trades: got %v want %v", len(response.Trades), 2)
+	}
+
+	if response.Trades[0].SellOrderID != iceberg.ID || response.Trades[1].SellOrderID != plain.ID {
+		t.Errorf("Expected the replenished iceberg to queue behind order %d, got sells %d then %d",
+			plain.ID, response.Trades[0].SellOrderID, response.Trades[1].SellOrderID)
+	}
+}
+
+func amendOrder(t *testing.T, token string, orderID uint, payload types.AmendOrderPayload) types.PlaceOrderResponse {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("/order/%d", orderID), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v, body: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	var response types.PlaceOrderResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	return response
+}
+
+func TestAmendOrderAdjustsReservation(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+	order := placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+
+	amendOrder(t, token, order.ID, types.AmendOrderPayload{Amount: "60"})
+	if balance := getBalance(t, token, createdToken.ID); balance != "940" {
+		t.Errorf("Unexpected balance after decrease: got %v want %v", balance, "940")
+	}
+
+	response := amendOrder(t, token, order.ID, types.AmendOrderPayload{Amount: "150", Price: "12"})
+	if balance := getBalance(t, token, createdToken.ID); balance != "850" {
+		t.Errorf("Unexpected balance after increase: got %v want %v", balance, "850")
+	}
+
+	if response.Amount.String() != "150" || response.Price.String() != "12" {
+		t.Errorf("Unexpected amended order: amount %v, price %v", response.Amount, response.Price)
+	}
+}
+
+func TestAmendOrderPriority(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	first := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+	second := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+
+	amendOrder(t, sellerToken, first.ID, types.AmendOrderPayload{Amount: "8"})
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "1", Price: "10"})
+	if len(response.Trades) != 1 || response.Trades[0].SellOrderID != first.ID {
+		t.Fatalf("Expected a quantity decrease to keep priority, got %+v", response.Trades)
+	}
+
+	amendOrder(t, sellerToken, first.ID, types.AmendOrderPayload{Price: "11"})
+	amendOrder(t, sellerToken, first.ID, types.AmendOrderPayload{Price: "10"})
+	response = placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "1", Price: "10"})
+	if len(response.Trades) != 1 || response.Trades[0].SellOrderID != second.ID {
+		t.Errorf("Expected a price change to lose priority, got %+v", response.Trades)
+	}
+}
+
+func TestAmendOrderCrossesBook(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	ask := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "11"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "9"})
+
+	response := amendOrder(t, sellerToken, ask.ID, types.AmendOrderPayload{Price: "9"})
+	if response.Status != "filled" || len(response.Trades) != 1 {
+		t.Errorf("Unexpected order state: status %v, %d trades", response.Status, len(response.Trades))
+	}
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "10" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "10")
+	}
+}
+
+func cancelOrders(t *testing.T, token, path string, payload any) (int, types.CancelOrdersResponse) {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	var response types.CancelOrdersResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+	}
+	return rr.Code, response
+}
+
+func TestCancelAllOrders(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+	depositCash(t, token, "100")
+
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "50", Price: "11"})
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Kind: "stop", Amount: "10", TriggerPrice: "5"})
+	buy := placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "5"})
+
+	status, response := cancelOrders(t, token, "/order/cancel-all", types.CancelAllOrdersPayload{TokenID: createdToken.ID, OrderType: "sell"})
+	if status != http.StatusOK || len(response.CancelledOrderIDs) != 3 {
+		t.Fatalf("Unexpected cancel-all result: status %v, cancelled %v", status, response.CancelledOrderIDs)
+	}
+
+	if balance := getBalance(t, token, createdToken.ID); balance != "1000" {
+		t.Errorf("Unexpected balance: got %v want %v", balance, "1000")
+	}
+
+	if buys := listOrders(t, token, createdToken.ID, "buy"); len(buys) != 1 {
+		t.Errorf("Expected the buy order to stay on the book, found %d orders", len(buys))
+	}
+
+	status, response = cancelOrders(t, token, "/order/cancel-batch", types.CancelOrdersPayload{OrderIDs: []uint{buy.ID}})
+	if status != http.StatusOK || len(response.CancelledOrderIDs) != 1 || response.CancelledOrderIDs[0] != buy.ID {
+		t.Fatalf("Unexpected cancel-batch result: status %v, cancelled %v", status, response.CancelledOrderIDs)
+	}
+
+	if balance := getCashBalance(t, token); balance != "100" {
+		t.Errorf("Unexpected cash balance: got %v want %v", balance, "100")
+	}
+}
+
+func TestCancelOrdersReportsLinkedOrders(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+
+	oco := placeOCO(t, token, types.PlaceOCOPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "12", TriggerPrice: "8"})
+
+	status, response := cancelOrders(t, token, "/order/cancel-batch", types.CancelOrdersPayload{OrderIDs: []uint{oco.LimitOrder.ID}})
+	if status != http.StatusOK || len(response.CancelledOrderIDs) != 2 || response.CancelledOrderIDs[1] != oco.StopOrder.ID {
+		t.Fatalf("Unexpected cancel-batch result: status %v, cancelled %v", status, response.CancelledOrderIDs)
+	}
+	if status := getOrderStatus(t, oco.StopOrder.ID); status != "cancelled" {
+		t.Errorf("Expected the stop order to be cancelled, got %v", status)
+	}
+}
+
+func TestCancelOrdersRejectsOtherUsersOrders(t *testing.T) {
+	_, ownerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, ownerToken)
+	order := placeOrder(t, ownerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+
+	_, otherToken := createRandomUser(t)
+	if status, _ := cancelOrders(t, otherToken, "/order/cancel-batch", types.CancelOrdersPayload{OrderIDs: []uint{order.ID}}); status == http.StatusOK {
+		t.Errorf("Expected cancelling another user's order to fail")
+	}
+
+	if sells := listOrders(t, ownerToken, createdToken.ID, "sell"); len(sells) != 1 {
+		t.Errorf("Expected the order to stay on the book, found %d orders", len(sells))
+	}
+}
+
+func TestSelfTradePreventionCancelsNewestByDefault(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+	depositCash(t, token, "1000")
+
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+	response := placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10"})
+
+	if response.Status != "cancelled" || len(response.Trades) != 0 {
+		t.Errorf("Unexpected order state: status %v, %d trades", response.Status, len(response.Trades))
+	}
+
+	if sells := listOrders(t, token, createdToken.ID, "sell"); len(sells) != 1 {
+		t.Errorf("Expected the resting order to stay on the book, found %d orders", len(sells))
+	}
+
+	if balance := getCashBalance(t, token); balance != "1000" {
+		t.Errorf("Unexpected cash balance: got %v want %v", balance, "1000")
+	}
+}
+
+func TestSelfTradePreventionModes(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+	depositCash(t, token, "1000")
+
+	placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+	response := placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10", SelfTradePrevention: "cancel_oldest"})
+	if response.Status != "open" {
+		t.Errorf("Unexpected newest order status: got %v want %v", response.Status, "open")
+	}
+	if sells := listOrders(t, token, createdToken.ID, "sell"); len(sells) != 0 {
+		t.Errorf("Expected the oldest order to be cancelled, found %d sells", len(sells))
+	}
+
+	response = placeOrder(t, token, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "4", Price: "10", SelfTradePrevention: "decrement"})
+	if response.Status != "cancelled" || len(response.Trades) != 0 {
+		t.Errorf("Unexpected newest order state: status %v, %d trades", response.Status, len(response.Trades))
+	}
+
+	buys := listOrders(t, token, createdToken.ID, "buy")
+	if len(buys) != 1 || buys[0].RemainingAmount.String() != "6" {
+		t.Fatalf("Expected the oldest order to be decremented to 6, got %+v", buys)
+	}
+
+	if balance := getCashBalance(t, token); balance != "940" {
+		t.Errorf("Unexpected cash balance: got %v want %v", balance, "940")
+	}
+
+	if balance := getBalance(t, token, createdToken.ID); balance != "1000" {
+		t.Errorf("Unexpected balance: got %v want %v", balance, "1000")
+	}
+}
+
+func TestPlaceOrderWithClientOrderIDIsIdempotent(t *testing.T) {
+	_, token := createRandomUser(t)
+	createdToken := createTokenForUser(t, token)
+
+	payload := types.PlaceOrderPayload{ClientOrderID: "retry-me", TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"}
+	first := placeOrder(t, token, payload)
+
+	rr := tryPlaceOrder(t, token, payload)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var retried types.PlaceOrderResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &retried); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if retried.ID != first.ID || retried.ClientOrderID != "retry-me" {
+		t.Errorf("Expected the retry to return order %d, got order %d", first.ID, retried.ID)
+	}
+
+	if balance := getBalance(t, token, createdToken.ID); balance != "900" {
+		t.Errorf("Unexpected balance: got %v want %v", balance, "900")
+	}
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+
+	req, _ := http.NewRequest("GET", "/order/client/retry-me", nil)
+	req.Header.Set("Authorization", token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var order types.Order
+	if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil || order.ID != first.ID {
+		t.Fatalf("Unexpected lookup by client order ID: status %v, body %s", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/order/cancel/client/retry-me", nil)
+	req.Header.Set("Authorization", token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if balance := getBalance(t, token, createdToken.ID); balance != "1000" {
+		t.Errorf("Unexpected balance after cancel: got %v want %v", balance, "1000")
+	}
+}
+
+func TestHandleExecuteBuyOrder(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "100")
+	bid := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "5"})
+
+	body, _ := json.Marshal(types.ExecuteOrderPayload{OrderID: bid.ID, Amount: "4"})
+	req, _ := http.NewRequest("POST", "/order/execute", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", sellerToken)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v, body: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	if balance := getBalance(t, sellerToken, createdToken.ID); balance != "996" {
+		t.Errorf("Unexpected seller balance: got %v want %v", balance, "996")
+	}
+
+	if balance := getCashBalance(t, sellerToken); balance != "20" {
+		t.Errorf("Unexpected seller cash balance: got %v want %v", balance, "20")
+	}
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "4" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "4")
+	}
+
+	if balance := getCashBalance(t, buyerToken); balance != "50" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "50")
+	}
+
+	buys := listOrders(t, buyerToken, createdToken.ID, "buy")
+	if len(buys) != 1 || buys[0].RemainingAmount.String() != "6" {
+		t.Errorf("Unexpected resting buy orders: %+v", buys)
+	}
+}
+
+func setTradingHalt(t *testing.T, token, path string, payload any) (int, types.TradingStatus) {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	var status types.TradingStatus
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	return rr.Code, status
+}
+
+func getTradingStatus(t *testing.T, tokenID uint) types.TradingStatus {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/market/%d/status", tokenID), nil)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var status types.TradingStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	return status
+}
+
+func TestHaltTradingRejectsNewActivity(t *testing.T) {
+	_, ownerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, ownerToken)
+	sell := placeOrder(t, ownerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+
+	admin, adminToken := createRandomUser(t)
+	if _, err := testDB.Exec("UPDATE users SET isAdmin = TRUE WHERE email = ?", admin.Email); err != nil {
+		t.Fatalf("Failed to make user an admin: %v", err)
+	}
+
+	haltPath := fmt.Sprintf("/market/%d/halt", createdToken.ID)
+	if code, _ := setTradingHalt(t, ownerToken, haltPath, types.HaltTradingPayload{Reason: "maintenance"}); code != http.StatusForbidden {
+		t.Fatalf("Expected a non-admin halt to be forbidden, got status %v", code)
+	}
+
+	code, status := setTradingHalt(t, adminToken, haltPath, types.HaltTradingPayload{Reason: "maintenance"})
+	if code != http.StatusOK || !status.Halted || status.Reason != "maintenance" || status.ResumesAt != nil {
+		t.Fatalf("Unexpected halt result: status %v, %+v", code, status)
+	}
+
+	if status := getTradingStatus(t, createdToken.ID); !status.Halted || status.Reason != "maintenance" {
+		t.Errorf("Expected the token to be halted, got %+v", status)
+	}
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	if rr := tryPlaceOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10"}); rr.Code == http.StatusCreated {
+		t.Errorf("Expected placing an order to fail while halted")
+	}
+
+	body, _ := json.Marshal(types.ExecuteOrderPayload{OrderID: sell.ID, Amount: "10"})
+	req, _ := http.NewRequest("POST", "/order/execute", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", buyerToken)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if rr.Code == http.StatusOK {
+		t.Errorf("Expected executing an order to fail while halted")
+	}
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/order/cancel/%d", sell.ID), nil)
+	req.Header.Set("Authorization", ownerToken)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected cancelling to work while halted, got status %v", rr.Code)
+	}
+
+	code, status = setTradingHalt(t, adminToken, fmt.Sprintf("/market/%d/resume", createdToken.ID), nil)
+	if code != http.StatusOK || status.Halted {
+		t.Fatalf("Unexpected resume result: status %v, %+v", code, status)
+	}
+
+	placeOrder(t, ownerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+}
+
+func TestCircuitBreakerHaltsTrading(t *testing.T) {
+	// the breaker is off unless configured
+	config.Envs.CircuitBreakerPercent = 10
+	defer func() { config.Envs.CircuitBreakerPercent = 0 }()
+
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "100"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "105"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "120"})
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "10000")
+
+	// a 5% move stays within the breaker
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "20", Price: "105"})
+	if status := getTradingStatus(t, createdToken.ID); status.Halted {
+		t.Fatalf("Expected trading to continue, got %+v", status)
+	}
+
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "5", Price: "120"})
+	status := getTradingStatus(t, createdToken.ID)
+	if !status.Halted || status.ResumesAt == nil {
+		t.Fatalf("Expected the circuit breaker to halt trading, got %+v", status)
+	}
+
+	if rr := tryPlaceOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "5", Price: "120"}); rr.Code == http.StatusCreated {
+		t.Errorf("Expected placing an order to fail while halted")
+	}
+}
+
+func TestMarketRulesValidatePlacement(t *testing.T) {
+	_, ownerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, ownerToken)
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	rulesPath := fmt.Sprintf("/market/%d/rules", createdToken.ID)
+
+	updateRules := func(token string, payload types.UpdateMarketRulesPayload) int {
+		body, _ := json.Marshal(payload)
+		req, _ := http.NewRequest("PUT", rulesPath, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	payload := types.UpdateMarketRulesPayload{TickSize: "5", LotSize: "10", MinQuantity: "20", MaxQuantity: "100", MinNotional: "500"}
+	_, otherToken := createRandomUser(t)
+	if code := updateRules(otherToken, payload); code == http.StatusOK {
+		t.Fatalf("Expected another user to be unable to change the rules")
+	}
+	if code := updateRules(ownerToken, payload); code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+
+	req, _ := http.NewRequest("GET", rulesPath, nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var rules types.MarketRules
+	if err := json.Unmarshal(rr.Body.Bytes(), &rules); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if rules.TickSize.String() != "5" || rules.LotSize.String() != "10" || rules.MaxQuantity.String() != "100" {
+		t.Errorf("Unexpected market rules: %+v", rules)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		amount string
+		price  string
+	}{
+		{"price off tick", "50", "12"},
+		{"amount off lot", "55", "10"},
+		{"below min quantity", "10", "100"},
+		{"above max quantity", "110", "10"},
+		{"below min notional", "20", "10"},
+	} {
+		if rr := tryPlaceOrder(t, ownerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: tc.amount, Price: tc.price}); rr.Code == http.StatusCreated {
+			t.Errorf("%s: expected the order to be rejected", tc.name)
+		}
+	}
+
+	placeOrder(t, ownerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "50", Price: "10"})
+}
+
+// startAuction schedules an auction of the given kind on the token that has
+// already started and ends in an hour
+func startAuction(t *testing.T, token string, tokenID uint, kind string) {
+	// startsAt is stored to the second and could round up into the future
+	body, _ := json.Marshal(types.ScheduleAuctionPayload{Kind: kind, StartsAt: time.Now().Add(-time.Second), EndsAt: time.Now().Add(time.Hour)})
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/market/%d/auctions", tokenID), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+}
+
+// endAuctions uncrosses every auction that started before now, as the
+// auction runner would once they end
+func endAuctions(t *testing.T) {
+	auctionRunner.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	defer func() { auctionRunner.now = time.Now }()
+
+	if err := auctionRunner.RunDue(context.Background()); err != nil {
+		t.Fatalf("Failed to uncross auction: %v", err)
+	}
+}
+
+func TestCallAuctionUncrossesAtEquilibrium(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+
+	startAuction(t, sellerToken, createdToken.ID, "")
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "3000")
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "11"})
+	if response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "150", Price: "12"}); len(response.Trades) != 0 {
+		t.Fatalf("Expected no trades during the auction, got %d", len(response.Trades))
+	}
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "50", Price: "9"})
+
+	if rr := tryPlaceOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Kind: "market", Amount: "10"}); rr.Code == http.StatusCreated {
+		t.Errorf("Expected market orders to be rejected during the auction")
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/market/%d/auction", createdToken.ID), nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var auction types.Auction
+	if err := json.Unmarshal(rr.Body.Bytes(), &auction); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if auction.IndicativePrice == nil || auction.IndicativePrice.String() != "11" || auction.IndicativeVolume.String() != "150" {
+		t.Fatalf("Unexpected indicative price: %s", rr.Body.String())
+	}
+
+	endAuctions(t)
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "150" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "150")
+	}
+
+	// 150 at 12 and 50 at 9 were reserved, and 1 back per token bought at 11
+	if balance := getCashBalance(t, buyerToken); balance != "900" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "900")
+	}
+
+	if balance := getCashBalance(t, sellerToken); balance != "1650" {
+		t.Errorf("Unexpected seller cash balance: got %v want %v", balance, "1650")
+	}
+
+	// nobody took liquidity in the uncross
+	if tape := getTradeTape(t, createdToken.ID, ""); len(tape) == 0 || tape[0]["aggressorSide"] != nil {
+		t.Errorf("Unexpected trade tape after the uncross: %v", tape)
+	}
+
+	sells := listOrders(t, sellerToken, createdToken.ID, "sell")
+	if len(sells) != 1 || sells[0].Price.String() != "11" || sells[0].RemainingAmount.String() != "50" {
+		t.Errorf("Unexpected resting sell orders: %+v", sells)
+	}
+
+	response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "11"})
+	if len(response.Trades) != 1 {
+		t.Errorf("Expected continuous trading after the uncross, got %d trades", len(response.Trades))
+	}
+}
+
+func TestUncrossLeavesNoCrossBehindSelfTrades(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	depositCash(t, sellerToken, "100")
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "100")
+
+	startAuction(t, sellerToken, createdToken.ID, "")
+
+	// the equilibrium of 10 only crosses the seller with themselves, which
+	// hides the buyer's 9 crossing the seller's 8
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "8"})
+	buy := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "5", Price: "9"})
+
+	endAuctions(t)
+
+	if status := getOrderStatus(t, buy.ID); status != "filled" {
+		t.Errorf("Expected the buyer's order to fill after the uncross, got %v", status)
+	}
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "5" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "5")
+	}
+
+	// bought at the resting sell's 8 with 9 reserved
+	if balance := getCashBalance(t, buyerToken); balance != "60" {
+		t.Errorf("Unexpected buyer cash balance: got %v want %v", balance, "60")
+	}
+
+	sells := listOrders(t, sellerToken, createdToken.ID, "sell")
+	if len(sells) != 1 || sells[0].RemainingAmount.String() != "5" {
+		t.Errorf("Unexpected resting sell orders: %+v", sells)
+	}
+}
+
+func TestStopOrdersWaitForAuctionToUncross(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10"})
+
+	startAuction(t, sellerToken, createdToken.ID, "")
+
+	// the last trade price has already reached the trigger
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "20", Price: "10"})
+	stop := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Kind: "stop_limit", Amount: "20", Price: "10", TriggerPrice: "9"})
+	if stop.Status != "pending_trigger" || len(stop.Trades) != 0 {
+		t.Fatalf("Expected the stop order to wait for the auction, got status %v and %d trades", stop.Status, len(stop.Trades))
+	}
+
+	endAuctions(t)
+
+	if status := getOrderStatus(t, stop.ID); status != "filled" {
+		t.Errorf("Expected the stop order to trigger and fill after the uncross, got %v", status)
+	}
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "30" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "30")
+	}
+}
+
+func TestClosingAuctionClosesBookUntilNextAuction(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+
+	startAuction(t, sellerToken, createdToken.ID, "closing")
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "20", Price: "10"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10"})
+	endAuctions(t)
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "10" {
+		t.Errorf("Unexpected buyer balance after the close: got %v want %v", balance, "10")
+	}
+
+	// the closed book collects orders without matching them
+	if response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10"}); len(response.Trades) != 0 {
+		t.Errorf("Expected no trades while the book is closed, got %d", len(response.Trades))
+	}
+	if rr := tryPlaceOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Kind: "market", Amount: "10"}); rr.Code == http.StatusCreated {
+		t.Errorf("Expected market orders to be rejected while the book is closed")
+	}
+
+	startAuction(t, sellerToken, createdToken.ID, "opening")
+	endAuctions(t)
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "20" {
+		t.Errorf("Unexpected buyer balance after the open: got %v want %v", balance, "20")
+	}
+
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+	if response := placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "10", Price: "10"}); len(response.Trades) != 1 {
+		t.Errorf("Expected continuous trading after the open, got %d trades", len(response.Trades))
+	}
+}
+
+func placeOCO(t *testing.T, token string, payload types.PlaceOCOPayload) types.PlaceOCOResponse {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", "/order/oco", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	var response types.PlaceOCOResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	return response
+}
+
+func getOrderStatus(t *testing.T, orderID uint) string {
+	var status string
+	if err := testDB.QueryRow("SELECT status FROM orders WHERE id = ?", orderID).Scan(&status); err != nil {
+		t.Fatalf("Failed to get order status: %v", err)
+	}
+	return status
+}
+
+func TestOCOLimitFillCancelsStop(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	oco := placeOCO(t, sellerToken, types.PlaceOCOPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "12", TriggerPrice: "8"})
+	if oco.LimitOrder.Status != "open" || oco.StopOrder.Status != "pending_trigger" {
+		t.Fatalf("Unexpected OCO orders: %+v %+v", oco.LimitOrder, oco.StopOrder)
+	}
+
+	if balance := getBalance(t, sellerToken, createdToken.ID); balance != "900" {
+		t.Errorf("Unexpected balance: got %v want %v", balance, "900")
+	}
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1200")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "40", Price: "12"})
+
+	if status := getOrderStatus(t, oco.StopOrder.ID); status != "cancelled" {
+		t.Errorf("Expected the stop order to be cancelled, got %v", status)
+	}
+
+	if status := getOrderStatus(t, oco.LimitOrder.ID); status != "partially_filled" {
+		t.Errorf("Expected the limit order to stay on the book, got %v", status)
+	}
+}
+
+func TestOCOStopTriggerCancelsLimit(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "1", Price: "8"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "100", Price: "8"})
+
+	// the limit order holds the tokens the stop order sells once triggered
+	oco := placeOCO(t, sellerToken, types.PlaceOCOPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "999", Price: "12", TriggerPrice: "8"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "1", Price: "8"})
+
+	if status := getOrderStatus(t, oco.LimitOrder.ID); status != "cancelled" {
+		t.Errorf("Expected the limit order to be cancelled, got %v", status)
+	}
+
+	if status := getOrderStatus(t, oco.StopOrder.ID); status != "cancelled" {
+		t.Errorf("Expected the stop order to sell what it could and cancel the rest, got %v", status)
+	}
+
+	if balance := getBalance(t, buyerToken, createdToken.ID); balance != "101" {
+		t.Errorf("Unexpected buyer balance: got %v want %v", balance, "101")
+	}
+
+	if balance := getBalance(t, sellerToken, createdToken.ID); balance != "899" {
+		t.Errorf("Unexpected seller balance: got %v want %v", balance, "899")
+	}
+}
+
+func getMyTrades(t *testing.T, token, query string) types.UserTradesResponse {
+	req, _ := http.NewRequest("GET", "/trades/me?"+query, nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var response types.UserTradesResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	return response
+}
+
+func TestGetMyTradesFiltersAndPaginates(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+	otherToken := createTokenForUser(t, sellerToken)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "10000")
+	for _, price := range []string{"10", "11", "12"} {
+		placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "5", Price: price})
+		placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "5", Price: price})
+	}
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: otherToken.ID, OrderType: "sell", Amount: "1", Price: "20"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: otherToken.ID, OrderType: "buy", Amount: "1", Price: "20"})
+
+	all := getMyTrades(t, buyerToken, "")
+	if len(all.Trades) != 4 || all.NextCursor != 0 {
+		t.Fatalf("Expected 4 trades on one page, got %d with cursor %d", len(all.Trades), all.NextCursor)
+	}
+	if all.Trades[0].TokenID != otherToken.ID || all.Trades[0].Role != "buyer" || all.Trades[0].Notional.String() != "20" {
+		t.Errorf("Unexpected newest trade: %+v", all.Trades[0])
+	}
+
+	page := getMyTrades(t, sellerToken, fmt.Sprintf("tokenId=%d&limit=2", createdToken.ID))
+	if len(page.Trades) != 2 || page.NextCursor == 0 {
+		t.Fatalf("Expected a full first page, got %d trades with cursor %d", len(page.Trades), page.NextCursor)
+	}
+	if page.Trades[0].Role != "seller" || page.Trades[0].Price.String() != "12" || page.Trades[0].Notional.String() != "60" {
+		t.Errorf("Unexpected trade: %+v", page.Trades[0])
+	}
+
+	page = getMyTrades(t, sellerToken, fmt.Sprintf("tokenId=%d&limit=2&cursor=%d", createdToken.ID, page.NextCursor))
+	if len(page.Trades) != 1 || page.NextCursor != 0 || page.Trades[0].Price.String() != "10" {
+		t.Fatalf("Unexpected last page: %+v", page)
+	}
+
+	if sells := getMyTrades(t, buyerToken, "side=sell"); len(sells.Trades) != 0 {
+		t.Errorf("Expected the buyer to have no sells, got %d", len(sells.Trades))
+	}
+
+	from := url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	to := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	if recent := getMyTrades(t, buyerToken, "from="+from+"&to="+to); len(recent.Trades) != 4 {
+		t.Errorf("Expected 4 trades within the last hour, got %d", len(recent.Trades))
+	}
+
+	from = to
+	if later := getMyTrades(t, buyerToken, "from="+from); len(later.Trades) != 0 {
+		t.Errorf("Expected no trades after %s, got %d", from, len(later.Trades))
+	}
+}
+
+func getMyOrders(t *testing.T, token, query string) (int, types.UserOrdersResponse) {
+	req, _ := http.NewRequest("GET", "/orders/me?"+query, nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	var response types.UserOrdersResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+	}
+	return rr.Code, response
+}
+
+func TestGetMyOrdersAcrossStatuses(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	resting := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "100", Price: "10"})
+	cancelled := placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "15"})
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/order/cancel/%d", cancelled.ID), nil)
+	req.Header.Set("Authorization", sellerToken)
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "30", Price: "11"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "20", Price: "10"})
+
+	_, all := getMyOrders(t, sellerToken, "")
+	if len(all.Orders) != 2 || all.NextCursor != 0 {
+		t.Fatalf("Expected 2 orders on one page, got %d with cursor %d", len(all.Orders), all.NextCursor)
+	}
+	if all.Orders[0].ID != cancelled.ID || all.Orders[0].Status != "cancelled" || all.Orders[0].Fills.TradeCount != 0 {
+		t.Errorf("Unexpected newest order: %+v %+v", all.Orders[0].Order, all.Orders[0].Fills)
+	}
+
+	fills := all.Orders[1].Fills
+	if all.Orders[1].ID != resting.ID || all.Orders[1].Status != "partially_filled" {
+		t.Errorf("Unexpected oldest order: %+v", all.Orders[1].Order)
+	}
+	if fills.TradeCount != 2 || fills.Notional.String() != "500" || fills.AveragePrice.String() != "10" || fills.LastFillAt == nil {
+		t.Errorf("Unexpected fill summary: %+v", fills)
+	}
+
+	_, page := getMyOrders(t, buyerToken, fmt.Sprintf("tokenId=%d&status=filled&limit=1", createdToken.ID))
+	if len(page.Orders) != 1 || page.NextCursor == 0 || page.Orders[0].Amount.String() != "20" {
+		t.Fatalf("Unexpected first page: %+v", page)
+	}
+
+	// the buy at 11 traded at the resting order's price
+	_, page = getMyOrders(t, buyerToken, fmt.Sprintf("tokenId=%d&status=filled&limit=1&cursor=%d", createdToken.ID, page.NextCursor))
+	if len(page.Orders) != 1 || page.NextCursor != 0 || page.Orders[0].Fills.AveragePrice.String() != "10" {
+		t.Fatalf("Unexpected last page: %+v", page)
+	}
+
+	if _, open := getMyOrders(t, sellerToken, "status=open,partially_filled"); len(open.Orders) != 1 || open.Orders[0].ID != resting.ID {
+		t.Errorf("Expected only the resting order to be open, got %+v", open.Orders)
+	}
+
+	if code, _ := getMyOrders(t, sellerToken, "status=expired"); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown status to be rejected, got %v", code)
+	}
+}
+
+func getTradeTape(t *testing.T, tokenID uint, query string) []map[string]any {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/market/%d/trades?%s", tokenID, query), nil)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	orderHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v, body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	var tape []map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &tape); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	return tape
+}
+
+func TestTradeTape(t *testing.T) {
+	_, sellerToken := createRandomUser(t)
+	createdToken := createTokenForUser(t, sellerToken)
+
+	_, buyerToken := createRandomUser(t)
+	depositCash(t, buyerToken, "1000")
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "10", Price: "10"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "4", Price: "10"})
+	placeOrder(t, buyerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "buy", Amount: "5", Price: "9"})
+	placeOrder(t, sellerToken, types.PlaceOrderPayload{TokenID: createdToken.ID, OrderType: "sell", Amount: "5", Price: "9"})
+
+	checkTape := func(tape []map[string]any) {
+		t.Helper()
+		if len(tape) != 2 {
+			t.Fatalf("Expected 2 trades on the tape, got %d", len(tape))
+		}
+		if tape[0]["sequence"] != float64(2) || tape[0]["aggressorSide"] != "sell" || tape[0]["price"] != float64(9) {
+			t.Errorf("Unexpected latest trade: %v", tape[0])
+		}
+		if tape[1]["sequence"] != float64(1) || tape[1]["aggressorSide"] != "buy" || tape[1]["amount"] != float64(4) {
+			t.Errorf("Unexpected first trade: %v", tape[1])
+		}
+		for _, trade := range tape {
+			if _, ok := trade["buyerId"]; ok {
+				t.Errorf("Expected the tape to leave out who traded: %v", trade)
+			}
+		}
+	}
+
+	checkTape(getTradeTape(t, createdToken.ID, ""))
+	if cached, err := db.GetTradeTape(createdToken.ID, 10); err != nil || len(cached) != 2 {
+		t.Errorf("Expected the tape to be in redis, got %d trades: %v", len(cached), err)
+	}
+
+	// a lost tape is served from the database and filled again
+	client, ctx := db.GetRedisClient()
+	client.Del(ctx, fmt.Sprintf("trade_tape:%d", createdToken.ID))
+	checkTape(getTradeTape(t, createdToken.ID, ""))
+	if cached, err := db.GetTradeTape(createdToken.ID, 10); err != nil || len(cached) != 2 {
+		t.Errorf("Expected the tape to be filled again, got %d trades: %v", len(cached), err)
+	}
+
+	if tape := getTradeTape(t, createdToken.ID, "limit=1"); len(tape) != 1 || tape[0]["sequence"] != float64(2) {
+		t.Errorf("Expected only the latest trade, got %v", tape)
+	}
+
+	// a tape missing older trades is not served short
+	client.LTrim(ctx, fmt.Sprintf("trade_tape:%d", createdToken.ID), 0, 0)
+	checkTape(getTradeTape(t, createdToken.ID, ""))
+}
@@ -1,36 +1,76 @@
 package order
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"math/big"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/dawumnam/token-trader/config"
 	"github.com/dawumnam/token-trader/db"
 	"github.com/dawumnam/token-trader/service/user/auth"
 	"github.com/dawumnam/token-trader/types"
 	"github.com/dawumnam/token-trader/utils"
+	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 )
 
+const (
+	defaultBookDepth = 20
+	maxBookDepth     = 100
+
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
 type Handler struct {
 	orderRepo types.OrderRepository
 	tokenRepo types.TokenRepository
 	userRepo  types.UserRepository
 	txManager *db.TxManager
+	matcher   *Matcher
 }
 
 func NewHandler(orderRepo types.OrderRepository, tokenRepo types.TokenRepository, userRepo types.UserRepository, txManager *db.TxManager) *Handler {
-	return &Handler{orderRepo: orderRepo, tokenRepo: tokenRepo, userRepo: userRepo, txManager: txManager}
+	return &Handler{
+		orderRepo: orderRepo,
+		tokenRepo: tokenRepo,
+		userRepo:  userRepo,
+		txManager: txManager,
+		matcher:   NewMatcher(orderRepo, tokenRepo),
+	}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/order/place", auth.WithJWTAuth(h.handlePlaceOrder, h.userRepo)).Methods("POST")
+	router.HandleFunc("/order/oco", auth.WithJWTAuth(h.handlePlaceOCOOrder, h.userRepo)).Methods("POST")
 	router.HandleFunc("/order/list/{tokenId}", auth.WithJWTAuth(h.handleListOrders, h.userRepo)).Methods("GET")
 	router.HandleFunc("/order/execute", auth.WithJWTAuth(h.handleExecuteOrder, h.userRepo)).Methods("POST")
 	router.HandleFunc("/order/cancel/{orderId}", auth.WithJWTAuth(h.handleCancelOrder, h.userRepo)).Methods("POST")
+	router.HandleFunc("/order/cancel/client/{clientOrderId}", auth.WithJWTAuth(h.handleCancelOrderByClientID, h.userRepo)).Methods("POST")
+	router.HandleFunc("/order/client/{clientOrderId}", auth.WithJWTAuth(h.handleGetOrderByClientID, h.userRepo)).Methods("GET")
+	router.HandleFunc("/order/cancel-all", auth.WithJWTAuth(h.handleCancelAllOrders, h.userRepo)).Methods("POST")
+	router.HandleFunc("/order/cancel-batch", auth.WithJWTAuth(h.handleCancelOrders, h.userRepo)).Methods("POST")
+	router.HandleFunc("/order/{orderId}", auth.WithJWTAuth(h.handleAmendOrder, h.userRepo)).Methods("PATCH")
+	router.HandleFunc("/orders/me", auth.WithJWTAuth(h.handleGetMyOrders, h.userRepo)).Methods("GET")
+	router.HandleFunc("/trades/me", auth.WithJWTAuth(h.handleGetMyTrades, h.userRepo)).Methods("GET")
+	router.HandleFunc("/market/{tokenId}/book", h.handleGetOrderBook).Methods("GET")
+	router.HandleFunc("/market/{tokenId}/trades", h.handleGetTradeTape).Methods("GET")
+	router.HandleFunc("/market/{tokenId}/status", h.handleGetTradingStatus).Methods("GET")
+	router.HandleFunc("/market/{tokenId}/rules", h.handleGetMarketRules).Methods("GET")
+	router.HandleFunc("/market/{tokenId}/rules", auth.WithJWTAuth(h.handleUpdateMarketRules, h.userRepo)).Methods("PUT")
+	router.HandleFunc("/market/{tokenId}/auction", h.handleGetAuction).Methods("GET")
+	router.HandleFunc("/market/{tokenId}/auctions", auth.WithJWTAuth(h.handleScheduleAuction, h.userRepo)).Methods("POST")
+	router.HandleFunc("/market/{tokenId}/halt", auth.WithJWTAuth(h.handleHaltTrading, h.userRepo)).Methods("POST")
+	router.HandleFunc("/market/{tokenId}/resume", auth.WithJWTAuth(h.handleResumeTrading, h.userRepo)).Methods("POST")
 }
 
 func (h *Handler) handlePlaceOrder(w http.ResponseWriter, r *http.Request) {
@@ -40,44 +80,211 @@ func (h *Handler) handlePlaceOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
 	userID := r.Context().Value("userID").(int)
 	amount, ok := new(big.Int).SetString(payload.Amount, 10)
-	if !ok {
+	if !ok || amount.Sign() <= 0 {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid amount"))
 		return
 	}
-	price, ok := new(big.Int).SetString(payload.Price, 10)
-	if !ok {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid price"))
+
+	if payload.Kind == "" {
+		payload.Kind = "limit"
+	}
+	isStop := payload.Kind == "stop" || payload.Kind == "stop_limit"
+	if payload.TimeInForce == "" {
+		payload.TimeInForce = "GTC"
+		if payload.Kind == "market" || payload.Kind == "stop" {
+			payload.TimeInForce = "IOC"
+		}
+	}
+
+	var price *big.Int
+	slippageBps := config.Envs.MarketSlippageBps
+	if payload.Kind == "limit" || payload.Kind == "stop_limit" {
+		price, ok = new(big.Int).SetString(payload.Price, 10)
+		if !ok || price.Sign() <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid price"))
+			return
+		}
+	} else {
+		if payload.Price != "" {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("market and stop orders do not take a price"))
+			return
+		}
+		if payload.TimeInForce != "IOC" && payload.TimeInForce != "FOK" {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("market and stop orders must be IOC or FOK"))
+			return
+		}
+		if payload.MaxSlippageBps != nil {
+			slippageBps = *payload.MaxSlippageBps
+		}
+	}
+
+	var triggerPrice *big.Int
+	if isStop {
+		triggerPrice, ok = new(big.Int).SetString(payload.TriggerPrice, 10)
+		if !ok || triggerPrice.Sign() <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid trigger price"))
+			return
+		}
+		// the market order a stop turns into is priced with the configured
+		// slippage when it triggers
+		if payload.MaxSlippageBps != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("stop orders do not take a max slippage"))
+			return
+		}
+		if price == nil {
+			price = big.NewInt(0)
+		}
+	} else if payload.TriggerPrice != "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("only stop orders take a trigger price"))
+		return
+	}
+
+	if payload.PostOnly && (payload.Kind == "market" || payload.Kind == "stop" || payload.TimeInForce == "IOC" || payload.TimeInForce == "FOK") {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("post-only orders must be limit orders that can rest on the book"))
+		return
+	}
+
+	if payload.ReduceOnly && payload.OrderType != "sell" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("only sell orders can be reduce-only"))
+		return
+	}
+
+	var displayAmount, visibleAmount *big.Int
+	if payload.DisplayAmount != "" {
+		if payload.Kind == "market" || payload.Kind == "stop" || payload.TimeInForce == "IOC" || payload.TimeInForce == "FOK" {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("iceberg orders must be limit orders that can rest on the book"))
+			return
+		}
+		displayAmount, ok = new(big.Int).SetString(payload.DisplayAmount, 10)
+		if !ok || displayAmount.Sign() <= 0 || displayAmount.Cmp(amount) >= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("display amount must be positive and less than the amount"))
+			return
+		}
+		visibleAmount = displayAmount
+	}
+
+	if payload.TimeInForce == "GTD" {
+		if payload.ExpiresAt == nil || !payload.ExpiresAt.After(time.Now()) {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("GTD orders need an expiry in the future"))
+			return
+		}
+	} else if payload.ExpiresAt != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("only GTD orders take an expiry"))
 		return
 	}
 
+	selfTradePrevention := payload.SelfTradePrevention
+	if selfTradePrevention == "" {
+		user, err := h.userRepo.GetUserById(userID)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %v", err))
+			return
+		}
+		selfTradePrevention = user.SelfTradePrevention
+	}
+
 	var newOrder *types.Order
+	var duplicate bool
+	trades := []*types.Trade{}
 	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
-		if payload.OrderType == "sell" {
-			balance, err := h.tokenRepo.GetTokenBalance(tx, uint(userID), payload.TokenID)
+		if err := h.orderRepo.LockOrderBook(tx, payload.TokenID); err != nil {
+			return err
+		}
+
+		// a retried placement gets back the order the first attempt placed,
+		// as it stands now
+		if payload.ClientOrderID != "" {
+			existing, err := h.orderRepo.GetOrderByClientID(tx, uint(userID), payload.ClientOrderID)
 			if err != nil {
 				return err
 			}
-			if balance.Cmp(amount) < 0 {
-				return fmt.Errorf("insufficient balance")
+			if existing != nil {
+				newOrder, duplicate = existing, true
+				return nil
 			}
-			err = h.tokenRepo.UpdateTokenBalance(tx, uint(userID), payload.TokenID, new(big.Int).Sub(balance, amount))
-			if err != nil {
+		}
+
+		if err := h.matcher.CheckTrading(tx, payload.TokenID); err != nil {
+			return err
+		}
+
+		// orders are only collected during an auction, so they must be able to
+		// rest on the book until it uncrosses
+		inAuction, err := h.matcher.InAuction(tx, payload.TokenID)
+		if err != nil {
+			return err
+		}
+		if inAuction && !isStop && (payload.Kind == "market" || payload.TimeInForce == "IOC" || payload.TimeInForce == "FOK") {
+			return fmt.Errorf("only orders that can rest on the book are accepted during an auction")
+		}
+
+		newOrder = &types.Order{
+			ClientOrderID:       payload.ClientOrderID,
+			UserID:              uint(userID),
+			TokenID:             payload.TokenID,
+			OrderType:           payload.OrderType,
+			Kind:                payload.Kind,
+			TimeInForce:         payload.TimeInForce,
+			Amount:              amount,
+			FilledAmount:        big.NewInt(0),
+			RemainingAmount:     amount,
+			Price:               price,
+			TriggerPrice:        triggerPrice,
+			Status:              "open",
+			ExpiresAt:           payload.ExpiresAt,
+			PostOnly:            payload.PostOnly,
+			ReduceOnly:          payload.ReduceOnly,
+			DisplayAmount:       displayAmount,
+			VisibleAmount:       visibleAmount,
+			SelfTradePrevention: selfTradePrevention,
+		}
+
+		if err := h.matcher.CheckMarketRules(tx, newOrder); err != nil {
+			return err
+		}
+
+		if newOrder.ReduceOnly {
+			if err := h.matcher.CheckReduceOnly(tx, newOrder); err != nil {
 				return err
 			}
 		}
 
-		newOrder = &types.Order{
-			UserID:    uint(userID),
-			TokenID:   payload.TokenID,
-			OrderType: payload.OrderType,
-			Amount:    amount,
-			Price:     price,
-			Status:    "open",
+		switch {
+		case isStop:
+			// stop orders reserve nothing until they trigger
+			newOrder.Status = "pending_trigger"
+			err = h.orderRepo.CreateOrder(tx, newOrder)
+		case inAuction:
+			if err = h.matcher.Reserve(tx, newOrder); err == nil {
+				err = h.orderRepo.CreateOrder(tx, newOrder)
+			}
+		default:
+			trades, err = h.placeLiveOrder(tx, newOrder, slippageBps)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := h.matcher.ProcessTriggers(tx, newOrder.TokenID); err != nil {
+			return err
+		}
+
+		if err := h.matcher.CheckCircuitBreaker(tx, newOrder.TokenID); err != nil {
+			return err
 		}
 
-		return h.orderRepo.CreateOrder(tx, newOrder)
+		// triggered orders may have traded with the new order, or the new
+		// order may have triggered straight away
+		newOrder, err = h.orderRepo.GetOrderByID(tx, newOrder.ID)
+		return err
 	})
 
 	if err != nil {
@@ -85,147 +292,1395 @@ func (h *Handler) handlePlaceOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, newOrder)
+	if duplicate {
+		utils.WriteJSON(w, http.StatusOK, types.PlaceOrderResponse{Order: newOrder, Trades: trades})
+		return
+	}
+	invalidateBook(payload.TokenID)
+	publishTrades(r.Context(), h.orderRepo, h.txManager, payload.TokenID)
+
+	utils.WriteJSON(w, http.StatusCreated, types.PlaceOrderResponse{Order: newOrder, Trades: trades})
 }
 
-func (h *Handler) handleListOrders(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
-	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
-		return
+// placeLiveOrder reserves what a new order can spend, persists it and crosses
+// it against the book
+func (h *Handler) placeLiveOrder(tx *sql.Tx, order *types.Order, slippageBps int64) ([]*types.Trade, error) {
+	if order.Kind == "market" {
+		if err := h.matcher.PriceMarketOrder(tx, order, slippageBps); err != nil {
+			return nil, err
+		}
 	}
 
-	orderType := r.URL.Query().Get("type")
-	if orderType != "buy" && orderType != "sell" {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order type"))
-		return
+	if order.PostOnly {
+		wouldCross, err := h.matcher.WouldCross(tx, order)
+		if err != nil {
+			return nil, err
+		}
+		if wouldCross {
+			return nil, errWouldCross
+		}
 	}
 
-	var orders []*types.Order
-	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
-		var err error
-		orders, err = h.orderRepo.GetOpenOrders(tx, uint(tokenID), orderType)
-		return err
-	})
+	if order.TimeInForce == "FOK" {
+		canFill, err := h.matcher.CanFill(tx, order)
+		if err != nil {
+			return nil, err
+		}
+		if !canFill {
+			return nil, fmt.Errorf("not enough liquidity to fill the order completely")
+		}
+	}
+
+	if err := h.matcher.Reserve(tx, order); err != nil {
+		return nil, err
+	}
+
+	if err := h.orderRepo.CreateOrder(tx, order); err != nil {
+		return nil, err
+	}
 
+	trades, err := h.matcher.Match(tx, order)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to list orders: %v", err))
-		return
+		return nil, err
 	}
 
-	utils.WriteJSON(w, http.StatusOK, orders)
+	// only GTC and GTD orders rest on the book
+	if order.TimeInForce == "IOC" && isOpen(order) {
+		return trades, h.matcher.CancelRemaining(tx, order)
+	}
+	return trades, nil
 }
 
-func (h *Handler) handleExecuteOrder(w http.ResponseWriter, r *http.Request) {
-	var payload types.ExecuteOrderPayload
+func (h *Handler) handlePlaceOCOOrder(w http.ResponseWriter, r *http.Request) {
+	var payload types.PlaceOCOPayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	buyerID := r.Context().Value("userID").(int)
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	userID := r.Context().Value("userID").(int)
+	amount, ok := new(big.Int).SetString(payload.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid amount"))
+		return
+	}
 
-	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
-		order, err := h.orderRepo.GetOrderByID(tx, payload.OrderID)
-		if err != nil {
-			return err
+	price, ok := new(big.Int).SetString(payload.Price, 10)
+	if !ok || price.Sign() <= 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid price"))
+		return
+	}
+
+	triggerPrice, ok := new(big.Int).SetString(payload.TriggerPrice, 10)
+	if !ok || triggerPrice.Sign() <= 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid trigger price"))
+		return
+	}
+
+	// the limit order takes profit and the stop order protects against the
+	// price moving the other way
+	takesProfit := price.Cmp(triggerPrice) > 0
+	if payload.OrderType == "buy" {
+		takesProfit = price.Cmp(triggerPrice) < 0
+	}
+	if !takesProfit {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("the price must be above the trigger price for sells and below it for buys"))
+		return
+	}
+
+	stopKind, stopPrice := "stop", big.NewInt(0)
+	if payload.StopPrice != "" {
+		stopKind = "stop_limit"
+		stopPrice, ok = new(big.Int).SetString(payload.StopPrice, 10)
+		if !ok || stopPrice.Sign() <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid stop price"))
+			return
 		}
+	}
 
-		if order.Status != "open" {
-			return fmt.Errorf("order is not open")
+	if payload.TimeInForce == "" {
+		payload.TimeInForce = "GTC"
+	}
+	if payload.TimeInForce == "GTD" {
+		if payload.ExpiresAt == nil || !payload.ExpiresAt.After(time.Now()) {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("GTD orders need an expiry in the future"))
+			return
 		}
-		sellerBalance, err := h.tokenRepo.GetTokenBalance(tx, order.UserID, order.TokenID)
+	} else if payload.ExpiresAt != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("only GTD orders take an expiry"))
+		return
+	}
+
+	selfTradePrevention := payload.SelfTradePrevention
+	if selfTradePrevention == "" {
+		user, err := h.userRepo.GetUserById(userID)
 		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %v", err))
+			return
+		}
+		selfTradePrevention = user.SelfTradePrevention
+	}
+
+	newOrder := func(kind string, price, triggerPrice *big.Int) *types.Order {
+		return &types.Order{
+			UserID:              uint(userID),
+			TokenID:             payload.TokenID,
+			OrderType:           payload.OrderType,
+			Kind:                kind,
+			TimeInForce:         payload.TimeInForce,
+			Amount:              amount,
+			FilledAmount:        big.NewInt(0),
+			RemainingAmount:     amount,
+			Price:               price,
+			TriggerPrice:        triggerPrice,
+			Status:              "open",
+			ExpiresAt:           payload.ExpiresAt,
+			SelfTradePrevention: selfTradePrevention,
+		}
+	}
+	limitOrder := newOrder("limit", price, nil)
+	stopOrder := newOrder(stopKind, stopPrice, triggerPrice)
+	stopOrder.Status = "pending_trigger"
+	if stopKind == "stop" {
+		// a stop order becomes a market order, which cannot rest on the book.
+		// It goes when the limit order expires.
+		stopOrder.TimeInForce, stopOrder.ExpiresAt = "IOC", nil
+	}
+
+	trades := []*types.Trade{}
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		if err := h.orderRepo.LockOrderBook(tx, payload.TokenID); err != nil {
 			return err
 		}
 
-		cmp := sellerBalance.Cmp(order.Amount)
-		if cmp < 0 {
-			return fmt.Errorf("user has insufficient amount of order")
+		if err := h.matcher.CheckTrading(tx, payload.TokenID); err != nil {
+			return err
 		}
 
-		err = h.tokenRepo.UpdateTokenBalance(tx, order.UserID, order.TokenID, new(big.Int).Sub(sellerBalance, order.Amount))
+		inAuction, err := h.matcher.InAuction(tx, payload.TokenID)
 		if err != nil {
 			return err
 		}
+		if inAuction {
+			return errInAuction
+		}
 
-		buyerBalance, err := h.tokenRepo.GetTokenBalance(tx, uint(buyerID), order.TokenID)
-		if err != nil {
+		for _, order := range []*types.Order{limitOrder, stopOrder} {
+			if err := h.matcher.CheckMarketRules(tx, order); err != nil {
+				return err
+			}
+		}
+
+		// both orders exist and are linked before the limit order can trade,
+		// so that a fill cancels the stop order straight away
+		if err := h.orderRepo.CreateOrder(tx, stopOrder); err != nil {
+			return err
+		}
+		if err := h.matcher.Reserve(tx, limitOrder); err != nil {
+			return err
+		}
+		if err := h.orderRepo.CreateOrder(tx, limitOrder); err != nil {
+			return err
+		}
+		if err := h.orderRepo.LinkOrders(tx, limitOrder.ID, stopOrder.ID); err != nil {
 			return err
 		}
 
-		err = h.tokenRepo.UpdateTokenBalance(tx, uint(buyerID), order.TokenID, new(big.Int).Add(buyerBalance, order.Amount))
+		trades, err = h.matcher.Match(tx, limitOrder)
 		if err != nil {
 			return err
 		}
 
-		trade := &types.Trade{
-			SellerID: order.UserID,
-			BuyerID:  uint(buyerID),
-			TokenID:  order.TokenID,
-			Amount:   order.Amount,
-			Price:    order.Price,
+		if err := h.matcher.ProcessTriggers(tx, payload.TokenID); err != nil {
+			return err
 		}
-		err = h.orderRepo.CreateTrade(tx, trade)
-		if err != nil {
+
+		if err := h.matcher.CheckCircuitBreaker(tx, payload.TokenID); err != nil {
 			return err
 		}
 
-		order.Status = "filled"
-		return h.orderRepo.UpdateOrderStatus(tx, order.ID, order.Status)
+		if limitOrder, err = h.orderRepo.GetOrderByID(tx, limitOrder.ID); err != nil {
+			return err
+		}
+		stopOrder, err = h.orderRepo.GetOrderByID(tx, stopOrder.ID)
+		return err
 	})
 
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to execute order: %v", err))
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to place OCO orders: %v", err))
 		return
 	}
+	invalidateBook(payload.TokenID)
+	publishTrades(r.Context(), h.orderRepo, h.txManager, payload.TokenID)
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "Order executed successfully"})
+	utils.WriteJSON(w, http.StatusCreated, types.PlaceOCOResponse{LimitOrder: limitOrder, StopOrder: stopOrder, Trades: trades})
 }
 
-func (h *Handler) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handleListOrders(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	orderID, err := strconv.ParseUint(vars["orderId"], 10, 32)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
 		return
 	}
 
 	userID := r.Context().Value("userID").(int)
+	orderType := r.URL.Query().Get("type")
+	if orderType != "buy" && orderType != "sell" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order type"))
+		return
+	}
 
+	var orders []*types.Order
 	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
-		order, err := h.orderRepo.GetOrderByID(tx, uint(orderID))
-		if err != nil {
-			return err
-		}
+		var err error
+		orders, err = h.orderRepo.GetOpenOrders(tx, uint(tokenID), orderType)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to list orders: %v", err))
+		return
+	}
 
+	for _, order := range orders {
 		if order.UserID != uint(userID) {
-			return fmt.Errorf("not authorized to cancel this order")
+			hideReserve(order)
 		}
+	}
 
-		if order.Status != "open" {
-			return fmt.Errorf("order is not open")
-		}
+	utils.WriteJSON(w, http.StatusOK, orders)
+}
 
-		if order.OrderType == "sell" {
-			balance, err := h.tokenRepo.GetTokenBalance(tx, uint(userID), order.TokenID)
-			if err != nil {
-				return err
-			}
-			err = h.tokenRepo.UpdateTokenBalance(tx, uint(userID), order.TokenID, new(big.Int).Add(balance, order.Amount))
-			if err != nil {
-				return err
+// handleGetMyOrders lists the user's orders in any status newest first, a
+// page at a time, each with a summary of its fills. They can be narrowed down
+// by token, a comma-separated list of statuses and a from/to time range.
+func (h *Handler) handleGetMyOrders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var filter types.OrderFilter
+	if param := query.Get("status"); param != "" {
+		for _, status := range strings.Split(param, ",") {
+			if !orderStatuses[status] {
+				utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid status %q", status))
+				return
 			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	var err error
+	if filter.TokenID, err = parseIDParam(query, "tokenId"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.BeforeID, err = parseIDParam(query, "cursor"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.From, err = parseTimeParam(query, "from"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.To, err = parseTimeParam(query, "to"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := parseLimitParam(query)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	filter.Limit = limit + 1
+
+	userID := uint(r.Context().Value("userID").(int))
+
+	response := types.UserOrdersResponse{Orders: []*types.UserOrder{}}
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		orders, err := h.orderRepo.GetUserOrders(tx, userID, filter)
+		if err != nil {
+			return err
+		}
+		if len(orders) > limit {
+			orders = orders[:limit]
+			response.NextCursor = orders[limit-1].ID
+		}
+
+		orderIDs := make([]uint, len(orders))
+		for i, order := range orders {
+			orderIDs[i] = order.ID
+		}
+		fills, err := h.orderRepo.GetFillSummaries(tx, orderIDs)
+		if err != nil {
+			return err
 		}
 
-		return h.orderRepo.UpdateOrderStatus(tx, order.ID, "cancelled")
+		for _, order := range orders {
+			response.Orders = append(response.Orders, &types.UserOrder{Order: order, Fills: fills[order.ID]})
+		}
+		return nil
 	})
 
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to cancel order: %v", err))
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get orders: %v", err))
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "Order cancelled successfully"})
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+var orderStatuses = map[string]bool{
+	"pending_trigger":  true,
+	"open":             true,
+	"partially_filled": true,
+	"filled":           true,
+	"cancelled":        true,
+}
+
+// handleGetMyTrades lists the user's trades newest first, a page at a time.
+// They can be narrowed down by token, side and a from/to time range.
+func (h *Handler) handleGetMyTrades(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := types.TradeFilter{Side: query.Get("side")}
+	if filter.Side != "" && filter.Side != "buy" && filter.Side != "sell" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("side must be buy or sell"))
+		return
+	}
+
+	var err error
+	if filter.TokenID, err = parseIDParam(query, "tokenId"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.BeforeID, err = parseIDParam(query, "cursor"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.From, err = parseTimeParam(query, "from"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.To, err = parseTimeParam(query, "to"); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := parseLimitParam(query)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	// one more trade than asked for tells whether there is another page
+	filter.Limit = limit + 1
+
+	userID := uint(r.Context().Value("userID").(int))
+
+	var trades []*types.Trade
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		trades, err = h.orderRepo.GetUserTrades(tx, userID, filter)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get trades: %v", err))
+		return
+	}
+
+	response := types.UserTradesResponse{Trades: []*types.UserTrade{}}
+	if len(trades) > limit {
+		trades = trades[:limit]
+		response.NextCursor = trades[limit-1].ID
+	}
+	for _, trade := range trades {
+		role := "seller"
+		if trade.BuyerID == userID {
+			role = "buyer"
+		}
+		response.Trades = append(response.Trades, &types.UserTrade{Trade: trade, Role: role, Notional: notional(trade.Price, trade.Amount)})
+	}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func parseIDParam(query url.Values, name string) (uint, error) {
+	param := query.Get(name)
+	if param == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(param, 10, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return uint(id), nil
+}
+
+func parseTimeParam(query url.Values, name string) (*time.Time, error) {
+	param := query.Get(name)
+	if param == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return &t, nil
+}
+
+func parseLimitParam(query url.Values) (int, error) {
+	param := query.Get("limit")
+	if param == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	return limit, nil
+}
+
+// hideReserve shows an iceberg order to other users as if its visible slice
+// were all that is left of it
+func hideReserve(order *types.Order) {
+	if order.DisplayAmount == nil {
+		return
+	}
+	order.Amount = new(big.Int).Add(order.FilledAmount, order.VisibleAmount)
+	order.RemainingAmount = order.VisibleAmount
+	order.DisplayAmount = nil
+}
+
+func (h *Handler) handleExecuteOrder(w http.ResponseWriter, r *http.Request) {
+	var payload types.ExecuteOrderPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	takerID := r.Context().Value("userID").(int)
+
+	var quantity *big.Int
+	if payload.Amount != "" {
+		var ok bool
+		quantity, ok = new(big.Int).SetString(payload.Amount, 10)
+		if !ok || quantity.Sign() <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid amount"))
+			return
+		}
+	}
+
+	taker, err := h.userRepo.GetUserById(takerID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %v", err))
+		return
+	}
+
+	var tokenID uint
+	var traded bool
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		order, err := h.matcher.LockOrder(tx, payload.OrderID)
+		if err != nil {
+			return err
+		}
+		tokenID = order.TokenID
+
+		if err := h.matcher.CheckTrading(tx, order.TokenID); err != nil {
+			return err
+		}
+
+		inAuction, err := h.matcher.InAuction(tx, order.TokenID)
+		if err != nil {
+			return err
+		}
+		if inAuction {
+			return errInAuction
+		}
+
+		if !isOpen(order) || isExpired(order) {
+			return fmt.Errorf("order is not open")
+		}
+
+		// only the visible slice of an iceberg order can be taken
+		if quantity == nil {
+			quantity = displayed(order)
+		}
+		if quantity.Cmp(displayed(order)) > 0 {
+			return fmt.Errorf("amount exceeds the order's remaining amount")
+		}
+		if payload.Amount != "" {
+			if err := h.matcher.CheckLotSize(tx, order.TokenID, quantity); err != nil {
+				return err
+			}
+		}
+
+		trade, err := h.matcher.Execute(tx, order, uint(takerID), quantity, taker.SelfTradePrevention)
+		if err != nil {
+			return err
+		}
+		traded = trade != nil
+
+		if err := h.matcher.ProcessTriggers(tx, order.TokenID); err != nil {
+			return err
+		}
+
+		return h.matcher.CheckCircuitBreaker(tx, order.TokenID)
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to execute order: %v", err))
+		return
+	}
+	invalidateBook(tokenID)
+	publishTrades(r.Context(), h.orderRepo, h.txManager, tokenID)
+
+	if !traded {
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "Self-trade prevented"})
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "Order executed successfully"})
+}
+
+func (h *Handler) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID, err := strconv.ParseUint(vars["orderId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+
+	h.cancelOrder(w, r, func(tx *sql.Tx) (uint, error) {
+		return uint(orderID), nil
+	})
+}
+
+func (h *Handler) handleCancelOrderByClientID(w http.ResponseWriter, r *http.Request) {
+	clientOrderID := mux.Vars(r)["clientOrderId"]
+	userID := r.Context().Value("userID").(int)
+
+	h.cancelOrder(w, r, func(tx *sql.Tx) (uint, error) {
+		order, err := h.getOrderByClientID(tx, uint(userID), clientOrderID)
+		if err != nil {
+			return 0, err
+		}
+		return order.ID, nil
+	})
+}
+
+// cancelOrder cancels the order that findOrder identifies for the user making
+// the request
+func (h *Handler) cancelOrder(w http.ResponseWriter, r *http.Request, findOrder func(tx *sql.Tx) (uint, error)) {
+	userID := r.Context().Value("userID").(int)
+
+	var tokenID uint
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		orderID, err := findOrder(tx)
+		if err != nil {
+			return err
+		}
+
+		order, err := h.matcher.LockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		tokenID = order.TokenID
+
+		if order.UserID != uint(userID) {
+			return fmt.Errorf("not authorized to cancel this order")
+		}
+
+		if !isWorking(order) {
+			return fmt.Errorf("order is not open")
+		}
+
+		return h.matcher.CancelRemaining(tx, order)
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to cancel order: %v", err))
+		return
+	}
+	invalidateBook(tokenID)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "Order cancelled successfully"})
+}
+
+func (h *Handler) handleGetOrderByClientID(w http.ResponseWriter, r *http.Request) {
+	clientOrderID := mux.Vars(r)["clientOrderId"]
+	userID := r.Context().Value("userID").(int)
+
+	var order *types.Order
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		order, err = h.getOrderByClientID(tx, uint(userID), clientOrderID)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get order: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, order)
+}
+
+func (h *Handler) getOrderByClientID(tx *sql.Tx, userID uint, clientOrderID string) (*types.Order, error) {
+	order, err := h.orderRepo.GetOrderByClientID(tx, userID, clientOrderID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("order not found")
+	}
+	return order, nil
+}
+
+func (h *Handler) handleCancelAllOrders(w http.ResponseWriter, r *http.Request) {
+	var payload types.CancelAllOrdersPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	userID := r.Context().Value("userID").(int)
+
+	var cancelled, tokenIDs []uint
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		orders, err := h.orderRepo.GetWorkingOrders(tx, uint(userID), payload.TokenID, payload.OrderType)
+		if err != nil {
+			return err
+		}
+
+		cancelled, tokenIDs, err = h.cancelOrders(tx, orders)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to cancel orders: %v", err))
+		return
+	}
+	for _, tokenID := range tokenIDs {
+		invalidateBook(tokenID)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.CancelOrdersResponse{CancelledOrderIDs: cancelled})
+}
+
+func (h *Handler) handleCancelOrders(w http.ResponseWriter, r *http.Request) {
+	var payload types.CancelOrdersPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	userID := r.Context().Value("userID").(int)
+
+	var cancelled, tokenIDs []uint
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		orders := make([]*types.Order, 0, len(payload.OrderIDs))
+		for _, orderID := range payload.OrderIDs {
+			order, err := h.orderRepo.GetOrderByID(tx, orderID)
+			if err != nil {
+				return err
+			}
+			if order.UserID != uint(userID) {
+				return fmt.Errorf("not authorized to cancel order %d", orderID)
+			}
+			orders = append(orders, order)
+		}
+
+		var err error
+		cancelled, tokenIDs, err = h.cancelOrders(tx, orders)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to cancel orders: %v", err))
+		return
+	}
+	for _, tokenID := range tokenIDs {
+		invalidateBook(tokenID)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.CancelOrdersResponse{CancelledOrderIDs: cancelled})
+}
+
+// cancelOrders cancels whichever of orders are still working once the books
+// they are on are locked, and returns their IDs along with the tokens whose
+// books were touched. Books are locked in token order so that concurrent bulk
+// cancels cannot deadlock.
+func (h *Handler) cancelOrders(tx *sql.Tx, orders []*types.Order) ([]uint, []uint, error) {
+	var tokenIDs []uint
+	seen := map[uint]bool{}
+	for _, order := range orders {
+		if !seen[order.TokenID] {
+			seen[order.TokenID] = true
+			tokenIDs = append(tokenIDs, order.TokenID)
+		}
+	}
+	sort.Slice(tokenIDs, func(i, j int) bool { return tokenIDs[i] < tokenIDs[j] })
+
+	for _, tokenID := range tokenIDs {
+		if err := h.orderRepo.LockOrderBook(tx, tokenID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cancelled := []uint{}
+	for _, order := range orders {
+		// the order may have been filled or cancelled before the lock was held
+		order, err := h.orderRepo.GetOrderByID(tx, order.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isWorking(order) {
+			continue
+		}
+
+		// the other order of a one-cancels-other pair is cancelled along
+		// with it
+		linkedID, err := h.orderRepo.GetLinkedOrderID(tx, order.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		var linked *types.Order
+		if linkedID != 0 {
+			if linked, err = h.orderRepo.GetOrderByID(tx, linkedID); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if err := h.matcher.CancelRemaining(tx, order); err != nil {
+			return nil, nil, err
+		}
+		cancelled = append(cancelled, order.ID)
+		if linked != nil && isWorking(linked) {
+			cancelled = append(cancelled, linked.ID)
+		}
+	}
+
+	return cancelled, tokenIDs, nil
+}
+
+func (h *Handler) handleAmendOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID, err := strconv.ParseUint(vars["orderId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+
+	var payload types.AmendOrderPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if payload.Price == "" && payload.Amount == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("nothing to amend"))
+		return
+	}
+
+	var price, amount *big.Int
+	if payload.Price != "" {
+		var ok bool
+		price, ok = new(big.Int).SetString(payload.Price, 10)
+		if !ok || price.Sign() <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid price"))
+			return
+		}
+	}
+	if payload.Amount != "" {
+		var ok bool
+		amount, ok = new(big.Int).SetString(payload.Amount, 10)
+		if !ok || amount.Sign() <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid amount"))
+			return
+		}
+	}
+
+	userID := r.Context().Value("userID").(int)
+
+	var order *types.Order
+	var trades []*types.Trade
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		order, err = h.matcher.LockOrder(tx, uint(orderID))
+		if err != nil {
+			return err
+		}
+
+		if order.UserID != uint(userID) {
+			return fmt.Errorf("not authorized to amend this order")
+		}
+
+		if err := h.matcher.CheckTrading(tx, order.TokenID); err != nil {
+			return err
+		}
+
+		inAuction, err := h.matcher.InAuction(tx, order.TokenID)
+		if err != nil {
+			return err
+		}
+		if inAuction {
+			return errInAuction
+		}
+
+		if !isOpen(order) || isExpired(order) {
+			return fmt.Errorf("order is not open")
+		}
+
+		if price == nil {
+			price = order.Price
+		}
+		if amount == nil {
+			amount = order.Amount
+		}
+
+		amended := *order
+		amended.Price, amended.Amount = price, amount
+		if err := h.matcher.CheckMarketRules(tx, &amended); err != nil {
+			return err
+		}
+
+		trades, err = h.matcher.Amend(tx, order, price, amount)
+		if err != nil {
+			return err
+		}
+
+		if err := h.matcher.ProcessTriggers(tx, order.TokenID); err != nil {
+			return err
+		}
+
+		if err := h.matcher.CheckCircuitBreaker(tx, order.TokenID); err != nil {
+			return err
+		}
+
+		order, err = h.orderRepo.GetOrderByID(tx, order.ID)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to amend order: %v", err))
+		return
+	}
+	invalidateBook(order.TokenID)
+	publishTrades(r.Context(), h.orderRepo, h.txManager, order.TokenID)
+
+	utils.WriteJSON(w, http.StatusOK, types.PlaceOrderResponse{Order: order, Trades: trades})
+}
+
+func (h *Handler) handleGetOrderBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	depth := defaultBookDepth
+	if param := r.URL.Query().Get("depth"); param != "" {
+		depth, err = strconv.Atoi(param)
+		if err != nil || depth <= 0 || depth > maxBookDepth {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("depth must be between 1 and %d", maxBookDepth))
+			return
+		}
+	}
+
+	// the cache is only an optimisation, so the book is read from the
+	// database whenever redis fails
+	version, versionErr := db.GetOrderBookVersion(uint(tokenID))
+	if versionErr == nil {
+		cached, err := db.GetCachedOrderBook(uint(tokenID), version, depth)
+		if err == nil && cached != nil {
+			utils.WriteJSON(w, http.StatusOK, json.RawMessage(cached))
+			return
+		}
+	}
+
+	book := &types.OrderBook{TokenID: uint(tokenID)}
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		book.Bids, err = h.orderRepo.GetBookLevels(tx, uint(tokenID), "buy", depth)
+		if err != nil {
+			return err
+		}
+		book.Asks, err = h.orderRepo.GetBookLevels(tx, uint(tokenID), "sell", depth)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get order book: %v", err))
+		return
+	}
+
+	if encoded, err := json.Marshal(book); versionErr == nil && err == nil {
+		if err := db.CacheOrderBook(uint(tokenID), version, depth, encoded); err != nil {
+			log.Printf("failed to cache order book of token %d: %v", tokenID, err)
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, book)
+}
+
+// handleGetTradeTape lists the token's latest trades newest first, without
+// who made them. They are served from the tape in redis whenever it is filled.
+func (h *Handler) handleGetTradeTape(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	limit := defaultPageSize
+	if param := r.URL.Query().Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 || limit > db.TradeTapeLength {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", db.TradeTapeLength))
+			return
+		}
+	}
+
+	// a tape shorter than the limit is only served if it reaches back to the
+	// token's first trade, and so holds every trade there is
+	cached, tapeErr := db.GetTradeTape(uint(tokenID), limit)
+	if tapeErr == nil && len(cached) > 0 && (len(cached) == limit || startsAtFirstTrade(cached)) {
+		tape := make([]json.RawMessage, len(cached))
+		for i, trade := range cached {
+			tape[i] = json.RawMessage(trade)
+		}
+		utils.WriteJSON(w, http.StatusOK, tape)
+		return
+	}
+
+	var trades []*types.Trade
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		trades, err = h.orderRepo.GetRecentTrades(tx, uint(tokenID), 0, limit)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get trades: %v", err))
+		return
+	}
+
+	// the tape is empty after a redis restart until the next trade fills it
+	if tapeErr == nil && len(cached) == 0 && len(trades) > 0 {
+		publishTrades(r.Context(), h.orderRepo, h.txManager, uint(tokenID))
+	}
+
+	tape := make([]*types.TapeTrade, len(trades))
+	for i, trade := range trades {
+		tape[i] = tapeTrade(trade)
+	}
+	utils.WriteJSON(w, http.StatusOK, tape)
+}
+
+// startsAtFirstTrade reports whether the oldest trade on a tape, which lists
+// the newest first, is the token's first trade
+func startsAtFirstTrade(tape []string) bool {
+	var oldest types.TapeTrade
+	if err := json.Unmarshal([]byte(tape[len(tape)-1]), &oldest); err != nil {
+		return false
+	}
+	return oldest.Sequence == 1
+}
+
+func (h *Handler) handleGetTradingStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	var status *types.TradingStatus
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		status, err = h.orderRepo.GetTradingStatus(tx, uint(tokenID))
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get trading status: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+func (h *Handler) handleGetMarketRules(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	var rules *types.MarketRules
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		rules, err = h.tokenRepo.GetMarketRules(tx, uint(tokenID))
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get market rules: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, rules)
+}
+
+// handleUpdateMarketRules lets the token's issuer or an admin replace its
+// market rules. Orders already on the book are left as they are.
+func (h *Handler) handleUpdateMarketRules(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	var payload types.UpdateMarketRulesPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	rules := &types.MarketRules{TokenID: uint(tokenID)}
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  **big.Int
+	}{
+		{"tick size", payload.TickSize, &rules.TickSize},
+		{"lot size", payload.LotSize, &rules.LotSize},
+		{"min quantity", payload.MinQuantity, &rules.MinQuantity},
+		{"max quantity", payload.MaxQuantity, &rules.MaxQuantity},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, ok := new(big.Int).SetString(field.value, 10)
+		if !ok || value.Sign() <= 0 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid %s", field.name))
+			return
+		}
+		*field.dest = value
+	}
+
+	var ok bool
+	rules.MinNotional, ok = new(big.Int).SetString(payload.MinNotional, 10)
+	if !ok || rules.MinNotional.Sign() < 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid min notional"))
+		return
+	}
+
+	if rules.MaxQuantity != nil && rules.MaxQuantity.Cmp(rules.MinQuantity) < 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("max quantity must not be less than min quantity"))
+		return
+	}
+
+	user, err := h.userRepo.GetUserById(r.Context().Value("userID").(int))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %v", err))
+		return
+	}
+
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		if err := h.authorizeTokenChange(tx, uint(tokenID), user); err != nil {
+			return err
+		}
+
+		return h.tokenRepo.UpdateMarketRules(tx, rules)
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update market rules: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, rules)
+}
+
+// authorizeTokenChange fails unless user issued the token or is an admin
+func (h *Handler) authorizeTokenChange(tx *sql.Tx, tokenID uint, user *types.User) error {
+	token, err := h.tokenRepo.GetTokenByID(tx, tokenID)
+	if err != nil {
+		return err
+	}
+	if token.OwnerID != uint(user.ID) && !user.IsAdmin {
+		return fmt.Errorf("not authorized to change this token's market")
+	}
+	return nil
+}
+
+// handleGetAuction returns the token's running or next auction. A running
+// auction comes with the price and volume it would uncross at right now.
+func (h *Handler) handleGetAuction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	var auction *types.Auction
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		auction, err = h.tokenRepo.GetNextAuction(tx, uint(tokenID))
+		if err != nil || auction == nil {
+			return err
+		}
+
+		// a book closed by a closing auction publishes where the next one
+		// would open it
+		inAuction, err := h.matcher.InAuction(tx, uint(tokenID))
+		if err != nil || !inAuction {
+			return err
+		}
+
+		auction.IndicativePrice, auction.IndicativeVolume, err = h.matcher.IndicativePrice(tx, uint(tokenID))
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get auction: %v", err))
+		return
+	}
+
+	if auction == nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("no auction scheduled"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, auction)
+}
+
+func (h *Handler) handleScheduleAuction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	var payload types.ScheduleAuctionPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	if !payload.EndsAt.After(payload.StartsAt) || !payload.EndsAt.After(time.Now()) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("auctions must end in the future and after they start"))
+		return
+	}
+
+	user, err := h.userRepo.GetUserById(r.Context().Value("userID").(int))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %v", err))
+		return
+	}
+
+	if payload.Kind == "" {
+		payload.Kind = "opening"
+	}
+
+	auction := &types.Auction{
+		TokenID:  uint(tokenID),
+		Kind:     payload.Kind,
+		StartsAt: payload.StartsAt,
+		EndsAt:   payload.EndsAt,
+		Status:   "scheduled",
+	}
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		if err := h.authorizeTokenChange(tx, uint(tokenID), user); err != nil {
+			return err
+		}
+
+		overlaps, err := h.tokenRepo.HasOverlappingAuction(tx, uint(tokenID), auction.StartsAt, auction.EndsAt)
+		if err != nil {
+			return err
+		}
+		if overlaps {
+			return fmt.Errorf("the token already has an auction scheduled at that time")
+		}
+
+		return h.tokenRepo.CreateAuction(tx, auction)
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to schedule auction: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, auction)
+}
+
+func (h *Handler) handleHaltTrading(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	var payload types.HaltTradingPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	h.setTradingHalt(w, r, uint(tokenID), func(tx *sql.Tx) error {
+		// a manual halt lasts until trading is resumed
+		return h.orderRepo.HaltTrading(tx, uint(tokenID), payload.Reason, 0)
+	})
+}
+
+func (h *Handler) handleResumeTrading(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseUint(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	h.setTradingHalt(w, r, uint(tokenID), func(tx *sql.Tx) error {
+		return h.orderRepo.ResumeTrading(tx, uint(tokenID))
+	})
+}
+
+// setTradingHalt applies change under the book lock, so that it takes effect
+// between rather than during the token's trades, and replies with the
+// resulting trading status
+func (h *Handler) setTradingHalt(w http.ResponseWriter, r *http.Request, tokenID uint, change func(tx *sql.Tx) error) {
+	var status *types.TradingStatus
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		if err := h.orderRepo.LockOrderBook(tx, tokenID); err != nil {
+			return err
+		}
+
+		if err := change(tx); err != nil {
+			return err
+		}
+
+		var err error
+		status, err = h.orderRepo.GetTradingStatus(tx, tokenID)
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update trading status: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, status)
+}
+
+// requireAdmin replies with an error and returns false unless the user making
+// the request is an admin
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	userID := r.Context().Value("userID").(int)
+	user, err := h.userRepo.GetUserById(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %v", err))
+		return false
+	}
+	if !user.IsAdmin {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied"))
+		return false
+	}
+	return true
+}
+
+// publishTrades puts the token's trades that have been committed since it last
+// ran on the token's tape. The tape is only a cache, so failures are logged.
+func publishTrades(ctx context.Context, orderRepo types.OrderRepository, txManager *db.TxManager, tokenID uint) {
+	err := db.AppendTradeTape(tokenID, func(afterSequence uint64) ([][]byte, error) {
+		var trades []*types.Trade
+		err := txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+			var err error
+			trades, err = orderRepo.GetRecentTrades(tx, tokenID, afterSequence, db.TradeTapeLength)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := make([][]byte, 0, len(trades))
+		for i := len(trades) - 1; i >= 0; i-- {
+			trade, err := json.Marshal(tapeTrade(trades[i]))
+			if err != nil {
+				return nil, err
+			}
+			encoded = append(encoded, trade)
+		}
+		return encoded, nil
+	})
+	if err != nil {
+		log.Printf("failed to publish trades of token %d: %v", tokenID, err)
+	}
+}
+
+func tapeTrade(trade *types.Trade) *types.TapeTrade {
+	return &types.TapeTrade{
+		Sequence:      trade.Sequence,
+		TokenID:       trade.TokenID,
+		Amount:        trade.Amount,
+		Price:         trade.Price,
+		AggressorSide: trade.AggressorSide,
+		CreatedAt:     trade.CreatedAt,
+	}
+}
+
+// invalidateBook drops the cached depth of a book once a change to it has
+// been committed
+func invalidateBook(tokenID uint) {
+	if err := db.InvalidateOrderBook(tokenID); err != nil {
+		log.Printf("failed to invalidate order book of token %d: %v", tokenID, err)
+	}
 }
@@ -0,0 +1,73 @@
+package order
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+
+	"github.com/dawumnam/token-trader/types"
+)
+
+// CheckMarketRules fails unless order fits the market rules of its token.
+// Market and stop orders have no price yet, so only their amounts and trigger
+// prices are checked.
+func (m *Matcher) CheckMarketRules(tx *sql.Tx, order *types.Order) error {
+	rules, err := m.tokenRepo.GetMarketRules(tx, order.TokenID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkQuantity(rules, order.Amount); err != nil {
+		return err
+	}
+	if order.DisplayAmount != nil {
+		if err := checkMultiple("display amount", order.DisplayAmount, rules.LotSize); err != nil {
+			return err
+		}
+	}
+	if order.TriggerPrice != nil {
+		if err := checkMultiple("trigger price", order.TriggerPrice, rules.TickSize); err != nil {
+			return err
+		}
+	}
+
+	if order.Price == nil || order.Price.Sign() == 0 {
+		return nil
+	}
+	if err := checkMultiple("price", order.Price, rules.TickSize); err != nil {
+		return err
+	}
+	if notional := new(big.Int).Mul(order.Price, order.Amount); notional.Cmp(rules.MinNotional) < 0 {
+		return fmt.Errorf("order value must be at least %s", rules.MinNotional)
+	}
+	return nil
+}
+
+// CheckLotSize fails unless amount is a whole number of lots of the token
+func (m *Matcher) CheckLotSize(tx *sql.Tx, tokenID uint, amount *big.Int) error {
+	rules, err := m.tokenRepo.GetMarketRules(tx, tokenID)
+	if err != nil {
+		return err
+	}
+	return checkMultiple("amount", amount, rules.LotSize)
+}
+
+func checkQuantity(rules *types.MarketRules, amount *big.Int) error {
+	if err := checkMultiple("amount", amount, rules.LotSize); err != nil {
+		return err
+	}
+	if amount.Cmp(rules.MinQuantity) < 0 {
+		return fmt.Errorf("amount must be at least %s", rules.MinQuantity)
+	}
+	if rules.MaxQuantity != nil && amount.Cmp(rules.MaxQuantity) > 0 {
+		return fmt.Errorf("amount must be at most %s", rules.MaxQuantity)
+	}
+	return nil
+}
+
+func checkMultiple(name string, value, step *big.Int) error {
+	if new(big.Int).Mod(value, step).Sign() != 0 {
+		return fmt.Errorf("%s must be a multiple of %s", name, step)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package order
+
+import (
+	"database/sql"
+	"errors"
+	"math/big"
+
+	"github.com/dawumnam/token-trader/config"
+	"github.com/dawumnam/token-trader/types"
+)
+
+// ProcessTriggers turns the token's stop orders whose trigger the last trade
+// price has reached into live orders: stop orders become market orders and
+// stop_limit orders become limit orders. Activated orders can trade and move
+// the price further, so it repeats until no more orders trigger. Nothing
+// triggers while the book is in an auction; the uncross processes triggers
+// once it has set the price. Callers must hold the book lock for the token.
+func (m *Matcher) ProcessTriggers(tx *sql.Tx, tokenID uint) error {
+	inAuction, err := m.InAuction(tx, tokenID)
+	if err != nil || inAuction {
+		return err
+	}
+
+	for {
+		lastPrice, err := m.orderRepo.GetLastTradePrice(tx, tokenID)
+		if err != nil || lastPrice == nil {
+			return err
+		}
+
+		orders, err := m.orderRepo.GetTriggeredOrders(tx, tokenID, lastPrice)
+		if err != nil || len(orders) == 0 {
+			return err
+		}
+
+		for _, order := range orders {
+			if err := m.activate(tx, order); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// activate puts a triggered order on the book the way it would have been
+// placed. An order that can no longer be placed, because the book is empty, it
+// would break its post-only flag or its owner can no longer cover it, is
+// cancelled instead. A reduce-only sell is first cut down to what its owner
+// still holds.
+func (m *Matcher) activate(tx *sql.Tx, order *types.Order) error {
+	// a triggered stop cancels its one-cancels-other limit order first, which
+	// frees what the limit order had reserved for the stop to use
+	if err := m.cancelLinked(tx, order); err != nil {
+		return err
+	}
+
+	var err error
+	if order.Kind == "stop" {
+		order.Kind = "market"
+		err = m.PriceMarketOrder(tx, order, config.Envs.MarketSlippageBps)
+	} else {
+		order.Kind = "limit"
+	}
+
+	if err == nil && order.ReduceOnly {
+		err = m.clipToBalance(tx, order)
+	}
+
+	if order.DisplayAmount != nil {
+		order.VisibleAmount = minAmount(order.DisplayAmount, order.RemainingAmount)
+	}
+
+	if err == nil && order.PostOnly {
+		var wouldCross bool
+		wouldCross, err = m.WouldCross(tx, order)
+		if err == nil && wouldCross {
+			err = errWouldCross
+		}
+	}
+
+	if err == nil && order.TimeInForce == "FOK" {
+		var canFill bool
+		canFill, err = m.CanFill(tx, order)
+		if err == nil && !canFill {
+			err = errNoLiquidity
+		}
+	}
+
+	if err == nil {
+		err = m.Reserve(tx, order)
+	}
+
+	switch {
+	case errors.Is(err, errNoLiquidity), errors.Is(err, errWouldCross),
+		errors.Is(err, errInsufficientBalance), errors.Is(err, errInsufficientFunds):
+		order.Status = "cancelled"
+		return m.orderRepo.ActivateOrder(tx, order)
+	case err != nil:
+		return err
+	}
+
+	order.Status = "open"
+	if err := m.orderRepo.ActivateOrder(tx, order); err != nil {
+		return err
+	}
+
+	if _, err := m.Match(tx, order); err != nil {
+		return err
+	}
+
+	if order.TimeInForce == "IOC" && isOpen(order) {
+		return m.CancelRemaining(tx, order)
+	}
+	return nil
+}
+
+// clipToBalance cuts a sell down to the tokens its owner has free
+func (m *Matcher) clipToBalance(tx *sql.Tx, order *types.Order) error {
+	balance, err := m.tokenRepo.GetTokenBalance(tx, order.UserID, order.TokenID)
+	if err != nil {
+		return err
+	}
+	if balance.Sign() == 0 {
+		return errInsufficientBalance
+	}
+
+	if balance.Cmp(order.RemainingAmount) < 0 {
+		order.Amount = new(big.Int).Add(order.FilledAmount, balance)
+		order.RemainingAmount = balance
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package settlement
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/dawumnam/token-trader/types"
+)
+
+type Repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// GetTradesToSettle returns the oldest trades that are not in a batch yet and
+// locks them, so that they go into one batch only
+func (r *Repository) GetTradesToSettle(tx *sql.Tx, limit int) ([]*types.Trade, error) {
+	query := `SELECT id, sellerID, buyerID, tokenID, amount, price, createdAt
+              FROM trades
+              WHERE settlementBatchID IS NULL
+              ORDER BY id ASC
+              LIMIT ?
+              FOR UPDATE`
+	rows, err := tx.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting trades to settle: %w", err)
+	}
+	defer rows.Close()
+
+	var trades []*types.Trade
+	for rows.Next() {
+		var trade types.Trade
+		var amountStr, priceStr string
+		err := rows.Scan(&trade.ID, &trade.SellerID, &trade.BuyerID, &trade.TokenID, &amountStr, &priceStr, &trade.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning trade: %w", err)
+		}
+		trade.Amount, _ = new(big.Int).SetString(amountStr, 10)
+		trade.Price, _ = new(big.Int).SetString(priceStr, 10)
+		trades = append(trades, &trade)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating trades: %w", err)
+	}
+
+	return trades, nil
+}
+
+func (r *Repository) CreateBatch(tx *sql.Tx, batch *types.SettlementBatch) error {
+	query := `INSERT INTO settlement_batches (fromTradeID, toTradeID, status) VALUES (?, ?, ?)`
+	result, err := tx.Exec(query, batch.FromTradeID, batch.ToTradeID, batch.Status)
+	if err != nil {
+		return fmt.Errorf("error creating settlement batch: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+
+	batch.ID = uint(id)
+	return nil
+}
+
+func (r *Repository) AddTradesToBatch(tx *sql.Tx, batchID uint, tradeIDs []uint) error {
+	if len(tradeIDs) == 0 {
+		return nil
+	}
+
+	args := []any{batchID}
+	for _, id := range tradeIDs {
+		args = append(args, id)
+	}
+	query := `UPDATE trades SET settlementBatchID = ? WHERE id IN (?` + strings.Repeat(`, ?`, len(tradeIDs)-1) + `)`
+	if _, err := tx.Exec(query, args...); err != nil {
+		return fmt.Errorf("error adding trades to settlement batch: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) CreateTransfer(tx *sql.Tx, transfer *types.SettlementTransfer) error {
+	query := `INSERT INTO settlement_transfers (batchID, tokenID, fromUserID, toUserID, amount, status) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, transfer.BatchID, transfer.TokenID, transfer.FromUserID, transfer.ToUserID, transfer.Amount.String(), transfer.Status)
+	if err != nil {
+		return fmt.Errorf("error creating settlement transfer: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+
+	transfer.ID = uint(id)
+	return nil
+}
+
+func (r *Repository) GetUnfinishedTransfers(tx *sql.Tx) ([]*types.SettlementTransfer, error) {
+	query := `SELECT id, batchID, tokenID, fromUserID, toUserID, amount, fromAddress, toAddress, txHash, status, error
+              FROM settlement_transfers
+              WHERE status IN ('pending', 'submitting', 'submitted')
+              ORDER BY id ASC`
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error getting unfinished transfers: %w", err)
+	}
+	defer rows.Close()
+
+	var transfers []*types.SettlementTransfer
+	for rows.Next() {
+		var transfer types.SettlementTransfer
+		var amountStr string
+		var fromAddress, toAddress, txHash, transferError sql.NullString
+		err := rows.Scan(&transfer.ID, &transfer.BatchID, &transfer.TokenID, &transfer.FromUserID, &transfer.ToUserID, &amountStr,
+			&fromAddress, &toAddress, &txHash, &transfer.Status, &transferError)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning transfer: %w", err)
+		}
+		transfer.Amount, _ = new(big.Int).SetString(amountStr, 10)
+		transfer.FromAddress = fromAddress.String
+		transfer.ToAddress = toAddress.String
+		transfer.TxHash = txHash.String
+		transfer.Error = transferError.String
+		transfers = append(transfers, &transfer)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating transfers: %w", err)
+	}
+
+	return transfers, nil
+}
+
+func (r *Repository) UpdateTransfer(tx *sql.Tx, transfer *types.SettlementTransfer) error {
+	query := `UPDATE settlement_transfers SET fromAddress = ?, toAddress = ?, txHash = ?, status = ?, error = ? WHERE id = ?`
+	_, err := tx.Exec(query, nullableString(transfer.FromAddress), nullableString(transfer.ToAddress), nullableString(transfer.TxHash),
+		transfer.Status, nullableString(transfer.Error), transfer.ID)
+	if err != nil {
+		return fmt.Errorf("error updating settlement transfer: %w", err)
+	}
+	return nil
+}
+
+// CloseFinishedBatches marks every pending batch whose transfers have all been
+// resolved as settled, or as failed if any of its transfers failed
+func (r *Repository) CloseFinishedBatches(tx *sql.Tx) error {
+	query := `UPDATE settlement_batches b
+              SET b.status = CASE WHEN EXISTS (
+                      SELECT 1 FROM settlement_transfers t WHERE t.batchID = b.id AND t.status = 'failed'
+                  ) THEN 'failed' ELSE 'settled' END,
+                  b.settledAt = NOW()
+              WHERE b.status = 'pending' AND NOT EXISTS (
+                  SELECT 1 FROM settlement_transfers t
+                  WHERE t.batchID = b.id AND t.status IN ('pending', 'submitting', 'submitted')
+              )`
+	_, err := tx.Exec(query)
+	if err != nil {
+		return fmt.Errorf("error closing settlement batches: %w", err)
+	}
+	return nil
+}
+
+func nullableString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,352 @@
+package settlement
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dawumnam/token-trader/db"
+	"github.com/dawumnam/token-trader/types"
+)
+
+// confirmTimeout is how long a submitted transfer is waited on before
+// settlement moves on to other transfers
+const confirmTimeout = 5 * time.Minute
+
+// Service periodically pushes the offchain effect of trades onchain. Each run
+// nets the trades made since the last batch into one transfer per pair of
+// users and token, then submits the transfers and records their outcome.
+type Service struct {
+	settlementRepo types.SettlementRepository
+	tokenRepo      types.TokenRepository
+	userRepo       types.UserRepository
+	txManager      *db.TxManager
+	tokenManager   types.TokenManager
+	interval       time.Duration
+	batchSize      int
+}
+
+func NewService(settlementRepo types.SettlementRepository, tokenRepo types.TokenRepository, userRepo types.UserRepository, txManager *db.TxManager, tokenManager types.TokenManager, interval time.Duration, batchSize int) *Service {
+	return &Service{
+		settlementRepo: settlementRepo,
+		tokenRepo:      tokenRepo,
+		userRepo:       userRepo,
+		txManager:      txManager,
+		tokenManager:   tokenManager,
+		interval:       interval,
+		batchSize:      batchSize,
+	}
+}
+
+// Run settles once per interval until ctx is cancelled
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Settle(ctx); err != nil {
+			log.Printf("settlement failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Settle batches any new trades and works through every transfer that has not
+// reached a final state. Transfers already sent are only ever confirmed, never
+// sent again, so Settle is safe to call after a restart.
+func (s *Service) Settle(ctx context.Context) error {
+	if err := s.createBatch(ctx); err != nil {
+		return err
+	}
+
+	if err := s.processTransfers(ctx); err != nil {
+		return err
+	}
+
+	return s.txManager.RunInTransaction(ctx, s.settlementRepo.CloseFinishedBatches)
+}
+
+func (s *Service) createBatch(ctx context.Context) error {
+	return s.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+		// trades are marked with their batch, so one that commits after trades
+		// with higher IDs have been settled is still picked up
+		trades, err := s.settlementRepo.GetTradesToSettle(tx, s.batchSize)
+		if err != nil {
+			return err
+		}
+		if len(trades) == 0 {
+			return nil
+		}
+
+		batch := &types.SettlementBatch{
+			FromTradeID: trades[0].ID,
+			ToTradeID:   trades[len(trades)-1].ID,
+			Status:      "pending",
+		}
+		if err := s.settlementRepo.CreateBatch(tx, batch); err != nil {
+			return err
+		}
+
+		tradeIDs := make([]uint, len(trades))
+		for i, trade := range trades {
+			tradeIDs[i] = trade.ID
+		}
+		if err := s.settlementRepo.AddTradesToBatch(tx, batch.ID, tradeIDs); err != nil {
+			return err
+		}
+
+		for _, transfer := range netTrades(trades) {
+			transfer.BatchID = batch.ID
+			transfer.Status = "pending"
+			if err := s.settlementRepo.CreateTransfer(tx, transfer); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *Service) processTransfers(ctx context.Context) error {
+	var transfers []*types.SettlementTransfer
+	err := s.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		transfers, err = s.settlementRepo.GetUnfinishedTransfers(tx)
+		return err
+	})
+	if err != nil || len(transfers) == 0 {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := s.processTransfer(ctx, transfer); err != nil {
+			log.Printf("failed to settle transfer %d: %v", transfer.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) processTransfer(ctx context.Context, transfer *types.SettlementTransfer) error {
+	switch transfer.Status {
+	case "submitting":
+		// the process stopped after claiming the transfer but before recording
+		// its hash, so it may or may not have reached the chain
+		transfer.Status = "failed"
+		transfer.Error = "interrupted while submitting, check onchain before retrying"
+		return s.updateTransfer(ctx, transfer)
+	case "submitted":
+		return s.confirm(ctx, transfer)
+	}
+
+	var token *types.Token
+	err := s.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		token, err = s.tokenRepo.GetTokenByID(tx, transfer.TokenID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	switch token.Status {
+	case "pending", "deploying":
+		// the contract is still being deployed
+		return nil
+	case "failed":
+		transfer.Status = "failed"
+		transfer.Error = "token contract failed to deploy"
+		return s.updateTransfer(ctx, transfer)
+	}
+
+	from, err := s.holderAddress(token, transfer.FromUserID, transfer.Amount)
+	if err != nil {
+		return err
+	}
+	to, err := s.walletAddress(transfer.ToUserID)
+	if err != nil {
+		return err
+	}
+
+	transfer.FromAddress = from
+	transfer.ToAddress = to
+	if strings.EqualFold(from, to) {
+		transfer.Status = "skipped"
+		return s.updateTransfer(ctx, transfer)
+	}
+
+	transfer.Status = "submitting"
+	if err := s.updateTransfer(ctx, transfer); err != nil {
+		return err
+	}
+
+	var txHash string
+	if strings.EqualFold(from, s.tokenManager.Address()) {
+		txHash, err = s.tokenManager.TransferToken(ctx, token.ContractAddress, to, transfer.Amount)
+	} else {
+		txHash, err = s.tokenManager.TransferFrom(ctx, token.ContractAddress, from, to, transfer.Amount)
+	}
+	if err != nil && ctx.Err() != nil {
+		// cut short by shutdown, possibly after reaching the chain, so the
+		// transfer stays submitting and is reported as interrupted
+		return err
+	}
+	if err != nil {
+		transfer.Status = "failed"
+		transfer.Error = err.Error()
+		return s.updateTransfer(ctx, transfer)
+	}
+
+	transfer.TxHash = txHash
+	transfer.Status = "submitted"
+	if err := s.updateTransfer(ctx, transfer); err != nil {
+		return err
+	}
+
+	return s.confirm(ctx, transfer)
+}
+
+// confirm waits for a submitted transfer to be mined. A transfer whose outcome
+// is still open stays submitted for the next run to wait on again.
+func (s *Service) confirm(ctx context.Context, transfer *types.SettlementTransfer) error {
+	waitCtx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+
+	_, err := s.tokenManager.WaitMined(waitCtx, transfer.TxHash)
+	switch {
+	case errors.Is(err, types.ErrTransactionFailed):
+		transfer.Status = "failed"
+		transfer.Error = err.Error()
+	case err != nil:
+		return err
+	default:
+		transfer.Status = "confirmed"
+	}
+	return s.updateTransfer(ctx, transfer)
+}
+
+// holderAddress finds where a seller's tokens are held onchain. Tokens only
+// reach a user's wallet through settlement; everything else, including a
+// newly issued supply, is still held by the platform.
+func (s *Service) holderAddress(token *types.Token, userID uint, amount *big.Int) (string, error) {
+	wallet, err := s.walletAddress(userID)
+	if err != nil || strings.EqualFold(wallet, s.tokenManager.Address()) {
+		return wallet, err
+	}
+
+	balance, err := s.tokenManager.GetBalance(token.ContractAddress, wallet)
+	if err != nil {
+		return "", err
+	}
+	if balance.Cmp(amount) < 0 {
+		return s.tokenManager.Address(), nil
+	}
+	return wallet, nil
+}
+
+// walletAddress is the user's own wallet, or the platform's account for users
+// who have not proven they own one
+func (s *Service) walletAddress(userID uint) (string, error) {
+	user, err := s.userRepo.GetUserById(int(userID))
+	if err != nil {
+		return "", fmt.Errorf("failed to get user %d: %v", userID, err)
+	}
+	if user.WalletAddress == "" || !user.WalletVerified {
+		return s.tokenManager.Address(), nil
+	}
+	return user.WalletAddress, nil
+}
+
+// updateTransfer is not cancelled with ctx, as losing the record of a transfer
+// that has already been sent is what would lead to it being sent twice
+func (s *Service) updateTransfer(ctx context.Context, transfer *types.SettlementTransfer) error {
+	return s.txManager.RunInTransaction(context.WithoutCancel(ctx), func(tx *sql.Tx) error {
+		return s.settlementRepo.UpdateTransfer(tx, transfer)
+	})
+}
+
+type position struct {
+	userID uint
+	amount *big.Int
+}
+
+// netTrades reduces trades to the transfers that leave every user with the same
+// net position in each token: net sellers send to net buyers, and users whose
+// buys and sells cancel out do not appear at all
+func netTrades(trades []*types.Trade) []*types.SettlementTransfer {
+	net := map[uint]map[uint]*big.Int{}
+	add := func(tokenID, userID uint, delta *big.Int) {
+		if net[tokenID] == nil {
+			net[tokenID] = map[uint]*big.Int{}
+		}
+		if net[tokenID][userID] == nil {
+			net[tokenID][userID] = big.NewInt(0)
+		}
+		net[tokenID][userID].Add(net[tokenID][userID], delta)
+	}
+	for _, trade := range trades {
+		add(trade.TokenID, trade.BuyerID, trade.Amount)
+		add(trade.TokenID, trade.SellerID, new(big.Int).Neg(trade.Amount))
+	}
+
+	tokenIDs := make([]uint, 0, len(net))
+	for tokenID := range net {
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	sort.Slice(tokenIDs, func(i, j int) bool { return tokenIDs[i] < tokenIDs[j] })
+
+	var transfers []*types.SettlementTransfer
+	for _, tokenID := range tokenIDs {
+		var sellers, buyers []*position
+		for userID, amount := range net[tokenID] {
+			switch amount.Sign() {
+			case -1:
+				sellers = append(sellers, &position{userID: userID, amount: new(big.Int).Neg(amount)})
+			case 1:
+				buyers = append(buyers, &position{userID: userID, amount: new(big.Int).Set(amount)})
+			}
+		}
+		sort.Slice(sellers, func(i, j int) bool { return sellers[i].userID < sellers[j].userID })
+		sort.Slice(buyers, func(i, j int) bool { return buyers[i].userID < buyers[j].userID })
+
+		for i, j := 0, 0; i < len(sellers) && j < len(buyers); {
+			seller, buyer := sellers[i], buyers[j]
+			amount := new(big.Int).Set(seller.amount)
+			if buyer.amount.Cmp(amount) < 0 {
+				amount.Set(buyer.amount)
+			}
+
+			transfers = append(transfers, &types.SettlementTransfer{
+				TokenID:    tokenID,
+				FromUserID: seller.userID,
+				ToUserID:   buyer.userID,
+				Amount:     amount,
+			})
+
+			seller.amount.Sub(seller.amount, amount)
+			buyer.amount.Sub(buyer.amount, amount)
+			if seller.amount.Sign() == 0 {
+				i++
+			}
+			if buyer.amount.Sign() == 0 {
+				j++
+			}
+		}
+	}
+
+	return transfers
+}
@@ -0,0 +1,48 @@
+package settlement
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/dawumnam/token-trader/types"
+)
+
+func TestNetTrades(t *testing.T) {
+	trades := []*types.Trade{
+		{SellerID: 1, BuyerID: 2, TokenID: 1, Amount: big.NewInt(100)},
+		{SellerID: 2, BuyerID: 3, TokenID: 1, Amount: big.NewInt(40)},
+		{SellerID: 1, BuyerID: 3, TokenID: 1, Amount: big.NewInt(10)},
+		{SellerID: 3, BuyerID: 1, TokenID: 2, Amount: big.NewInt(5)},
+	}
+
+	transfers := netTrades(trades)
+
+	expected := []types.SettlementTransfer{
+		{TokenID: 1, FromUserID: 1, ToUserID: 2, Amount: big.NewInt(60)},
+		{TokenID: 1, FromUserID: 1, ToUserID: 3, Amount: big.NewInt(50)},
+		{TokenID: 2, FromUserID: 3, ToUserID: 1, Amount: big.NewInt(5)},
+	}
+
+	if len(transfers) != len(expected) {
+		t.Fatalf("Unexpected number of transfers: got %v want %v", len(transfers), len(expected))
+	}
+
+	for i, want := range expected {
+		got := transfers[i]
+		if got.TokenID != want.TokenID || got.FromUserID != want.FromUserID || got.ToUserID != want.ToUserID || got.Amount.Cmp(want.Amount) != 0 {
+			t.Errorf("Unexpected transfer %d: got %+v want %+v", i, got, want)
+		}
+	}
+}
+
+func TestNetTradesCancelsOut(t *testing.T) {
+	trades := []*types.Trade{
+		{SellerID: 1, BuyerID: 2, TokenID: 1, Amount: big.NewInt(100)},
+		{SellerID: 2, BuyerID: 1, TokenID: 1, Amount: big.NewInt(100)},
+		{SellerID: 3, BuyerID: 3, TokenID: 1, Amount: big.NewInt(7)},
+	}
+
+	if transfers := netTrades(trades); len(transfers) != 0 {
+		t.Errorf("Expected no transfers, got %+v", transfers)
+	}
+}
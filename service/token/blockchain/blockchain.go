@@ -3,47 +3,61 @@ package blockchain
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"math/big"
+	"sync"
 
 	"github.com/dawumnam/token-trader/config"
 	"github.com/dawumnam/token-trader/contracts"
 	"github.com/dawumnam/token-trader/types"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
 )
 
 const (
-	lineaSepoliaRPC        = "https://rpc.sepolia.linea.build"
-	gasLimit        uint64 = 3000000
-	gasPrice               = 1000000000 // 1 Gwei
+	gasLimit uint64 = 3000000
+	gasPrice        = 1000000000 // 1 Gwei
 )
 
-var (
-	platformAddress = config.Envs.PlatformAddress
-	privateKey      = config.Envs.ChainPrivateKey
-)
+// simulatedFunds is the ether the platform's account starts with on a
+// simulated chain
+var simulatedFunds = new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether))
+
+// chainClient is what TokenManager needs from a node. Both a dialed RPC client
+// and a simulated backend provide it.
+type chainClient interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	ethereum.TransactionReader
+	ethereum.ChainIDReader
+}
 
 type TokenManager struct {
-	client  *ethclient.Client
-	auth    *bind.TransactOpts
-	address common.Address
+	client          chainClient
+	auth            *bind.TransactOpts
+	address         common.Address
+	platformAddress common.Address
+	// commit mines the pending transactions of a simulated chain, which has no
+	// miner of its own. It does nothing on a real chain.
+	commit func()
+	close  func()
+	// sendMu is held from signing a transaction from the platform's account
+	// until it is sent, so that no two are signed with the same nonce
+	sendMu sync.Mutex
 }
 
-func NewTokenManager() (*TokenManager, error) {
-	client, err := ethclient.Dial(lineaSepoliaRPC)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the Ethereum client: %v", err)
-	}
-
-	chainID, err := client.ChainID(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("failed to get chain ID: %v", err)
-	}
-
-	privateKeyECDSA, err := crypto.HexToECDSA(privateKey)
+// NewTokenManager connects to the chain backend named by cfg.ChainBackend:
+// "rpc" dials cfg.ChainRPCURL, and "simulated" starts an in-memory chain with
+// the platform's account already funded, so nothing leaves the process
+func NewTokenManager(cfg config.Config) (*TokenManager, error) {
+	privateKeyECDSA, err := crypto.HexToECDSA(cfg.ChainPrivateKey)
 	if err != nil {
 		return nil, fmt.Errorf("invalid private key: %v", err)
 	}
@@ -56,69 +70,219 @@ func NewTokenManager() (*TokenManager, error) {
 
 	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
 
+	tm := &TokenManager{
+		address:         fromAddress,
+		platformAddress: common.HexToAddress(cfg.PlatformAddress),
+		commit:          func() {},
+	}
+
+	var chainID *big.Int
+	switch cfg.ChainBackend {
+	case "rpc":
+		client, err := ethclient.Dial(cfg.ChainRPCURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the Ethereum client: %v", err)
+		}
+		tm.client = client
+		tm.close = client.Close
+
+		if cfg.ChainID != 0 {
+			chainID = big.NewInt(cfg.ChainID)
+		}
+	case "simulated":
+		backend := simulated.NewBackend(ethtypes.GenesisAlloc{
+			fromAddress: {Balance: simulatedFunds},
+		})
+		tm.client = backend.Client()
+		tm.commit = func() { backend.Commit() }
+		tm.close = func() { backend.Close() }
+	default:
+		return nil, fmt.Errorf("unknown chain backend %q", cfg.ChainBackend)
+	}
+
+	if chainID == nil {
+		chainID, err = tm.client.ChainID(context.Background())
+		if err != nil {
+			tm.Close()
+			return nil, fmt.Errorf("failed to get chain ID: %v", err)
+		}
+	}
+
 	auth, err := bind.NewKeyedTransactorWithChainID(privateKeyECDSA, chainID)
 	if err != nil {
+		tm.Close()
 		return nil, fmt.Errorf("failed to create authorized transactor: %v", err)
 	}
 
 	auth.GasLimit = gasLimit
-	auth.GasPrice = big.NewInt(gasPrice)
+	// a simulated chain prices gas itself, and its base fee can start above
+	// the fixed price used on the public network
+	if cfg.ChainBackend == "rpc" {
+		auth.GasPrice = big.NewInt(gasPrice)
+	}
+	tm.auth = auth
 
-	return &TokenManager{
-		client:  client,
-		auth:    auth,
-		address: fromAddress,
-	}, nil
+	return tm, nil
 }
 
-func (tm *TokenManager) DeployToken(payload types.IssueTokenPayload) (*types.Token, error) {
+// Close disconnects from the node, or stops the simulated chain
+func (tm *TokenManager) Close() {
+	tm.close()
+}
+
+// DeployToken deploys the contract for a new token without waiting for it to
+// be mined. The deployment is signed first and handed to record together with
+// the contract's address and the transaction's hash, and only sent if record
+// reports it was recorded. No other transaction leaves the platform's account
+// in between, so the deployment is sent with the nonce it was signed with.
+func (tm *TokenManager) DeployToken(ctx context.Context, payload types.IssueTokenPayload, record func(contractAddress, txHash string, rawTx []byte) (bool, error)) error {
 	initialSupply, ok := new(big.Int).SetString(payload.InitialSupply, 10)
 	if !ok {
-		return nil, fmt.Errorf("invalid initial supply")
+		return fmt.Errorf("invalid initial supply")
 	}
 
+	tm.sendMu.Lock()
+	defer tm.sendMu.Unlock()
+
+	opts := tm.transactOpts(ctx)
+	opts.NoSend = true
 	address, tx, _, err := contracts.DeployContracts(
-		tm.auth,
+		opts,
 		tm.client,
 		payload.Name,
 		payload.Symbol,
 		initialSupply,
-		common.HexToAddress(platformAddress),
+		tm.platformAddress,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to deploy contract: %v", err)
+		return fmt.Errorf("failed to sign contract deployment: %v", err)
+	}
+
+	rawTx, err := tx.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode contract deployment: %v", err)
+	}
+
+	recorded, err := record(address.Hex(), tx.Hash().Hex(), rawTx)
+	if err != nil || !recorded {
+		return err
+	}
+
+	return tm.send(ctx, tx)
+}
+
+// SendTransaction submits a transaction signed earlier by the platform's
+// account without waiting for it to be mined. Once the account has used the
+// transaction's nonce it is not sent again: the nonce went either to this
+// transaction, sent before, or to one that replaced it, which WaitMined then
+// fails to find.
+func (tm *TokenManager) SendTransaction(ctx context.Context, rawTx []byte) error {
+	var tx ethtypes.Transaction
+	if err := tx.UnmarshalBinary(rawTx); err != nil {
+		return fmt.Errorf("invalid signed transaction: %v", err)
+	}
+
+	tm.sendMu.Lock()
+	defer tm.sendMu.Unlock()
+
+	nonce, err := tm.client.PendingNonceAt(ctx, tm.address)
+	if err != nil {
+		return fmt.Errorf("failed to get account nonce: %v", err)
 	}
+	if nonce > tx.Nonce() {
+		return nil
+	}
+
+	return tm.send(ctx, &tx)
+}
+
+// send submits a signed transaction. Callers must hold sendMu.
+func (tm *TokenManager) send(ctx context.Context, tx *ethtypes.Transaction) error {
+	if err := tm.client.SendTransaction(ctx, tx); err != nil {
+		return fmt.Errorf("failed to send transaction %s: %v", tx.Hash().Hex(), err)
+	}
+	tm.commit()
+
+	return nil
+}
+
+// transactOpts signs as the platform's account and gives up on the node once
+// ctx is done.
+func (tm *TokenManager) transactOpts(ctx context.Context) *bind.TransactOpts {
+	opts := *tm.auth
+	opts.Context = ctx
+	return &opts
+}
+
+// TransferToken sends tokens from the platform's own account. It returns the
+// hash of the submitted transaction without waiting for it to be mined.
+func (tm *TokenManager) TransferToken(ctx context.Context, tokenAddress string, to string, amount *big.Int) (string, error) {
+	token, err := contracts.NewContracts(common.HexToAddress(tokenAddress), tm.client)
+	if err != nil {
+		return "", fmt.Errorf("failed to instantiate a Token contract: %v", err)
+	}
+
+	tm.sendMu.Lock()
+	defer tm.sendMu.Unlock()
 
-	_, err = bind.WaitMined(context.Background(), tm.client, tx)
+	tx, err := token.Transfer(tm.transactOpts(ctx), common.HexToAddress(to), amount)
 	if err != nil {
-		return nil, fmt.Errorf("failed to wait for contract deployment: %v", err)
+		return "", fmt.Errorf("failed to transfer tokens: %v", err)
 	}
+	tm.commit()
 
-	return &types.Token{
-		ContractAddress: address.Hex(),
-		Name:            payload.Name,
-		Symbol:          payload.Symbol,
-		OwnerID:         uint(tm.auth.From.Big().Uint64()),
-	}, nil
+	return tx.Hash().Hex(), nil
 }
 
-func (tm *TokenManager) TransferToken(tokenAddress string, to string, amount *big.Int) error {
+// TransferFrom moves tokens between two holders using the allowance that
+// UserToken grants the platform on every recipient. It returns the hash of the
+// submitted transaction without waiting for it to be mined.
+func (tm *TokenManager) TransferFrom(ctx context.Context, tokenAddress string, from string, to string, amount *big.Int) (string, error) {
 	token, err := contracts.NewContracts(common.HexToAddress(tokenAddress), tm.client)
 	if err != nil {
-		return fmt.Errorf("failed to instantiate a Token contract: %v", err)
+		return "", fmt.Errorf("failed to instantiate a Token contract: %v", err)
 	}
 
-	tx, err := token.Transfer(tm.auth, common.HexToAddress(to), amount)
+	tm.sendMu.Lock()
+	defer tm.sendMu.Unlock()
+
+	tx, err := token.TransferFrom(tm.transactOpts(ctx), common.HexToAddress(from), common.HexToAddress(to), amount)
 	if err != nil {
-		return fmt.Errorf("failed to transfer tokens: %v", err)
+		return "", fmt.Errorf("failed to transfer tokens: %v", err)
 	}
+	tm.commit()
+
+	return tx.Hash().Hex(), nil
+}
 
-	_, err = bind.WaitMined(context.Background(), tm.client, tx)
+// WaitMined blocks until the transaction is mined, or until ctx is done, and
+// returns its block number. It fails with types.ErrTransactionFailed only if
+// the transaction reverted or the chain does not know it.
+func (tm *TokenManager) WaitMined(ctx context.Context, txHash string) (uint64, error) {
+	tx, _, err := tm.client.TransactionByHash(ctx, common.HexToHash(txHash))
+	if errors.Is(err, ethereum.NotFound) {
+		return 0, fmt.Errorf("%w: transaction %s not found", types.ErrTransactionFailed, txHash)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to wait for transfer transaction: %v", err)
+		return 0, fmt.Errorf("failed to find transaction %s: %v", txHash, err)
 	}
 
-	return nil
+	receipt, err := bind.WaitMined(ctx, tm.client, tx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for transaction %s: %v", txHash, err)
+	}
+
+	if receipt.Status != ethtypes.ReceiptStatusSuccessful {
+		return 0, fmt.Errorf("%w: transaction %s reverted", types.ErrTransactionFailed, txHash)
+	}
+
+	return receipt.BlockNumber.Uint64(), nil
+}
+
+// Address is the platform's own account, which holds every token that has not
+// been settled to a user's wallet
+func (tm *TokenManager) Address() string {
+	return tm.address.Hex()
 }
 
 func (tm *TokenManager) GetBalance(tokenAddress string, address string) (*big.Int, error) {
@@ -150,35 +314,43 @@ func (tm *TokenManager) GetPlatformAddress(tokenAddress string) (string, error)
 }
 
 // func main() {
-// 	tokenManager, err := NewTokenManager()
+// 	tokenManager, err := NewTokenManager(config.Envs)
 // 	if err != nil {
 // 		log.Fatalf("Error initializing tokenManager: %v", err)
 // 	}
 
-// 	err = tokenManager.TransferToken("0xCbe58bEFBEfDB02cD2cfEcCB5304E853b04864A1", "0x720cD79c896829f6142569EAdc46EBc9B497396C", big.NewInt(100000000000000000))
+// 	_, err = tokenManager.TransferToken(context.Background(), "0xCbe58bEFBEfDB02cD2cfEcCB5304E853b04864A1", "0x720cD79c896829f6142569EAdc46EBc9B497396C", big.NewInt(100000000000000000))
 // 	if err != nil {
 // 		log.Fatalf("Error when transferring tokens: %v", err)
 // 	}
 
-// newToken, err := tokenManager.DeployToken(types.IssueTokenPayload{
+// var txHash string
+// err = tokenManager.DeployToken(context.Background(), types.IssueTokenPayload{
 // 	Name:          "Test Token",
 // 	Symbol:        "TST",
 // 	InitialSupply: "1000000000000000000", // 1 token with 18 decimals
+// }, func(contractAddress, hash string, rawTx []byte) (bool, error) {
+// 	txHash = hash
+// 	return true, nil
 // })
 // if err != nil {
 // 	log.Fatalf("Error deploying token: %v", err)
 // }
 
-// fmt.Printf("New token deployed at address: %s\n", newToken.ContractAddress)
+// if _, err := tokenManager.WaitMined(context.Background(), txHash); err != nil {
+// 	log.Fatalf("Error waiting for deployment: %v", err)
+// }
+
+// fmt.Printf("New token deployed at address: %s\n", contractAddress)
 
-// balance, err := tokenManager.GetBalance(newToken.ContractAddress, tokenManager.address.Hex())
+// balance, err := tokenManager.GetBalance(contractAddress, tokenManager.address.Hex())
 // if err != nil {
 // 	log.Fatalf("Error getting balance: %v", err)
 // }
 
 // fmt.Printf("Balance of token owner: %s\n", balance.String())
 
-// platformAddr, err := tokenManager.GetPlatformAddress(newToken.ContractAddress)
+// platformAddr, err := tokenManager.GetPlatformAddress(contractAddress)
 // if err != nil {
 // 	log.Fatalf("Error getting platform address: %v", err)
 // }
@@ -0,0 +1,182 @@
+package token
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/dawumnam/token-trader/db"
+	"github.com/dawumnam/token-trader/types"
+)
+
+const (
+	deployQueueSize = 100
+	// pendingScanInterval is how often pending tokens that never made it onto
+	// the queue, or were left behind by a restart, are picked up
+	pendingScanInterval = time.Minute
+	// deployWaitTimeout is how long a deployment is waited on before the
+	// deployer moves on to other tokens
+	deployWaitTimeout = 5 * time.Minute
+)
+
+// Deployer deploys the contracts of newly issued tokens in the background, so
+// that issuing a token does not hold a request or a transaction open while the
+// deployment is mined. Once the contract is mined the owner is credited with
+// the initial supply.
+type Deployer struct {
+	tokenRepo    types.TokenRepository
+	txManager    *db.TxManager
+	tokenManager types.TokenManager
+	queue        chan uint
+}
+
+func NewDeployer(tokenRepo types.TokenRepository, txManager *db.TxManager, tokenManager types.TokenManager) *Deployer {
+	return &Deployer{
+		tokenRepo:    tokenRepo,
+		txManager:    txManager,
+		tokenManager: tokenManager,
+		queue:        make(chan uint, deployQueueSize),
+	}
+}
+
+// Enqueue schedules a pending token for deployment. It never blocks; a token
+// that does not fit in the queue is deployed by the next scan instead.
+func (d *Deployer) Enqueue(tokenID uint) {
+	select {
+	case d.queue <- tokenID:
+	default:
+	}
+}
+
+// Run deploys queued tokens until ctx is cancelled
+func (d *Deployer) Run(ctx context.Context) {
+	ticker := time.NewTicker(pendingScanInterval)
+	defer ticker.Stop()
+
+	d.deployPending(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tokenID := <-d.queue:
+			if err := d.deploy(ctx, tokenID); err != nil {
+				log.Printf("failed to deploy token %d: %v", tokenID, err)
+			}
+		case <-ticker.C:
+			d.deployPending(ctx)
+		}
+	}
+}
+
+func (d *Deployer) deployPending(ctx context.Context) {
+	var tokens []*types.Token
+	err := d.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		tokens, err = d.tokenRepo.GetPendingTokens(tx)
+		return err
+	})
+	if err != nil {
+		log.Printf("failed to get pending tokens: %v", err)
+		return
+	}
+
+	for _, token := range tokens {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := d.deploy(ctx, token.ID); err != nil {
+			log.Printf("failed to deploy token %d: %v", token.ID, err)
+		}
+	}
+}
+
+// deploy takes a pending token through to deployed or failed. The deployment
+// is signed and recorded before it is sent, so a token left deploying by a
+// restart is sent that same transaction again, unless it already went out, and
+// is never deployed a second time.
+func (d *Deployer) deploy(ctx context.Context, tokenID uint) error {
+	var token *types.Token
+	err := d.txManager.RunInTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		token, err = d.tokenRepo.GetTokenByID(tx, tokenID)
+		return err
+	})
+	if err != nil || (token.Status != "pending" && token.Status != "deploying") {
+		return err
+	}
+
+	switch {
+	case token.Status == "pending":
+		var signed, recorded bool
+		err := d.tokenManager.DeployToken(ctx, types.IssueTokenPayload{
+			Name:          token.Name,
+			Symbol:        token.Symbol,
+			InitialSupply: token.InitialSupply.String(),
+		}, func(contractAddress, txHash string, rawTx []byte) (bool, error) {
+			signed = true
+			err := d.txManager.RunInTransaction(context.WithoutCancel(ctx), func(tx *sql.Tx) error {
+				var err error
+				recorded, err = d.tokenRepo.SetTokenDeployTx(tx, token.ID, contractAddress, txHash, rawTx)
+				return err
+			})
+			token.ContractAddress = contractAddress
+			token.DeployTxHash = txHash
+			return recorded, err
+		})
+		// a send that errors may still have reached the chain, so the token
+		// stays deploying and the next scan sends it again
+		switch {
+		case err != nil && !signed:
+			token.Status = "failed"
+			token.DeployError = err.Error()
+			return d.finish(ctx, token)
+		case err != nil || !recorded:
+			return err
+		}
+	case token.DeployRawTx != nil:
+		// deployments recorded before their signed transaction was kept were
+		// already sent and are only waited on
+		if err := d.tokenManager.SendTransaction(ctx, token.DeployRawTx); err != nil {
+			return err
+		}
+	}
+
+	// a deployment whose outcome is still open stays deploying for the next
+	// scan to wait on again
+	waitCtx, cancel := context.WithTimeout(ctx, deployWaitTimeout)
+	defer cancel()
+	blockNumber, err := d.tokenManager.WaitMined(waitCtx, token.DeployTxHash)
+	switch {
+	case errors.Is(err, types.ErrTransactionFailed):
+		token.Status = "failed"
+		token.DeployError = err.Error()
+	case err != nil:
+		return err
+	default:
+		token.Status = "deployed"
+		token.BlockNumber = blockNumber
+	}
+	return d.finish(ctx, token)
+}
+
+// finish records the outcome of a deployment and, if it succeeded, credits the
+// owner with the initial supply in the same transaction, so the supply is
+// credited exactly once
+func (d *Deployer) finish(ctx context.Context, token *types.Token) error {
+	return d.txManager.RunInTransaction(context.WithoutCancel(ctx), func(tx *sql.Tx) error {
+		finished, err := d.tokenRepo.FinishTokenDeployment(tx, token)
+		if err != nil || !finished || token.Status != "deployed" {
+			return err
+		}
+
+		balance, err := d.tokenRepo.GetTokenBalance(tx, token.OwnerID, token.ID)
+		if err != nil {
+			return err
+		}
+
+		balance.Add(balance, token.InitialSupply)
+		return d.tokenRepo.UpdateTokenBalance(tx, token.OwnerID, token.ID, balance)
+	})
+}
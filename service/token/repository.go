@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/dawumnam/token-trader/types"
 )
@@ -16,9 +17,34 @@ func NewTokenRepository(db *sql.DB) *TokenRepository {
 	return &TokenRepository{db: db}
 }
 
+const tokenColumns = `id, contractAddress, name, symbol, ownerID, initialSupply, status, deployTxHash, blockNumber, deployError, createdAt, deployRawTx`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row rowScanner) (*types.Token, error) {
+	var token types.Token
+	var contractAddress, deployTxHash, deployError sql.NullString
+	var blockNumber sql.NullInt64
+	var initialSupplyStr string
+	err := row.Scan(&token.ID, &contractAddress, &token.Name, &token.Symbol, &token.OwnerID, &initialSupplyStr,
+		&token.Status, &deployTxHash, &blockNumber, &deployError, &token.CreatedAt, &token.DeployRawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ContractAddress = contractAddress.String
+	token.InitialSupply, _ = new(big.Int).SetString(initialSupplyStr, 10)
+	token.DeployTxHash = deployTxHash.String
+	token.BlockNumber = uint64(blockNumber.Int64)
+	token.DeployError = deployError.String
+	return &token, nil
+}
+
 func (r *TokenRepository) CreateToken(tx *sql.Tx, token *types.Token) error {
-	query := `INSERT INTO tokens (contractAddress, name, symbol, ownerID) VALUES (?, ?, ?, ?)`
-	result, err := tx.Exec(query, token.ContractAddress, token.Name, token.Symbol, token.OwnerID)
+	query := `INSERT INTO tokens (name, symbol, ownerID, initialSupply, status) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, token.Name, token.Symbol, token.OwnerID, token.InitialSupply.String(), token.Status)
 	if err != nil {
 		return fmt.Errorf("error creating token: %w", err)
 	}
@@ -33,23 +59,29 @@ func (r *TokenRepository) CreateToken(tx *sql.Tx, token *types.Token) error {
 }
 
 func (r *TokenRepository) GetTokenByID(tx *sql.Tx, id uint) (*types.Token, error) {
-	query := `SELECT id, contractAddress, name, symbol, ownerID, createdAt FROM tokens WHERE id = ?`
-	var token types.Token
-	err := tx.QueryRow(query, id).Scan(
-		&token.ID, &token.ContractAddress, &token.Name, &token.Symbol, &token.OwnerID, &token.CreatedAt,
-	)
+	query := `SELECT ` + tokenColumns + ` FROM tokens WHERE id = ?`
+	token, err := scanToken(tx.QueryRow(query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("token not found")
 		}
 		return nil, fmt.Errorf("error getting token: %w", err)
 	}
-	return &token, nil
+	return token, nil
 }
 
 func (r *TokenRepository) GetTokensByOwner(tx *sql.Tx, ownerID uint) ([]*types.Token, error) {
-	query := `SELECT id, contractAddress, name, symbol, ownerID, createdAt FROM tokens WHERE ownerID = ?`
-	rows, err := tx.Query(query, ownerID)
+	query := `SELECT ` + tokenColumns + ` FROM tokens WHERE ownerID = ?`
+	return r.queryTokens(tx, query, ownerID)
+}
+
+func (r *TokenRepository) GetPendingTokens(tx *sql.Tx) ([]*types.Token, error) {
+	query := `SELECT ` + tokenColumns + ` FROM tokens WHERE status IN ('pending', 'deploying') ORDER BY id ASC`
+	return r.queryTokens(tx, query)
+}
+
+func (r *TokenRepository) queryTokens(tx *sql.Tx, query string, args ...any) ([]*types.Token, error) {
+	rows, err := tx.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("error getting tokens: %w", err)
 	}
@@ -57,12 +89,11 @@ func (r *TokenRepository) GetTokensByOwner(tx *sql.Tx, ownerID uint) ([]*types.T
 
 	var tokens []*types.Token
 	for rows.Next() {
-		var token types.Token
-		err := rows.Scan(&token.ID, &token.ContractAddress, &token.Name, &token.Symbol, &token.OwnerID, &token.CreatedAt)
+		token, err := scanToken(rows)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning token: %w", err)
 		}
-		tokens = append(tokens, &token)
+		tokens = append(tokens, token)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -72,6 +103,46 @@ func (r *TokenRepository) GetTokensByOwner(tx *sql.Tx, ownerID uint) ([]*types.T
 	return tokens, nil
 }
 
+// SetTokenDeployTx records the signed deployment of a pending token and moves
+// it to deploying. It reports false if the token already has a deployment of
+// its own.
+func (r *TokenRepository) SetTokenDeployTx(tx *sql.Tx, tokenID uint, contractAddress, txHash string, rawTx []byte) (bool, error) {
+	query := `UPDATE tokens SET status = 'deploying', contractAddress = ?, deployTxHash = ?, deployRawTx = ?
+              WHERE id = ? AND status = 'pending' AND deployTxHash IS NULL`
+	result, err := tx.Exec(query, contractAddress, txHash, rawTx, tokenID)
+	if err != nil {
+		return false, fmt.Errorf("error recording token deployment: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error getting rows affected: %w", err)
+	}
+	return updated == 1, nil
+}
+
+// FinishTokenDeployment records the final status of the deployment in
+// token.DeployTxHash. It reports false if that deployment was already finished
+// or is not the one recorded for the token.
+func (r *TokenRepository) FinishTokenDeployment(tx *sql.Tx, token *types.Token) (bool, error) {
+	query := `UPDATE tokens SET status = ?, blockNumber = ?, deployError = ?
+              WHERE id = ? AND status IN ('pending', 'deploying') AND deployTxHash <=> ?`
+	var blockNumber any
+	if token.BlockNumber != 0 {
+		blockNumber = token.BlockNumber
+	}
+	result, err := tx.Exec(query, token.Status, blockNumber, nullableString(token.DeployError), token.ID, nullableString(token.DeployTxHash))
+	if err != nil {
+		return false, fmt.Errorf("error finishing token deployment: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error getting rows affected: %w", err)
+	}
+	return updated == 1, nil
+}
+
 func (r *TokenRepository) UpdateTokenBalance(tx *sql.Tx, userID, tokenID uint, amount *big.Int) error {
 	query := `INSERT INTO balances (userID, tokenID, amount) VALUES (?, ?, ?)
               ON DUPLICATE KEY UPDATE amount = ?`
@@ -100,3 +171,225 @@ func (r *TokenRepository) GetTokenBalance(tx *sql.Tx, userID, tokenID uint) (*bi
 
 	return amount, nil
 }
+
+func (r *TokenRepository) UpdateCashBalance(tx *sql.Tx, userID uint, amount *big.Int) error {
+	query := `INSERT INTO cash_balances (userID, amount) VALUES (?, ?)
+              ON DUPLICATE KEY UPDATE amount = ?`
+	_, err := tx.Exec(query, userID, amount.String(), amount.String())
+	if err != nil {
+		return fmt.Errorf("error updating cash balance: %w", err)
+	}
+	return nil
+}
+
+// GetCashBalance locks the user's cash row until the transaction ends, as cash
+// is shared by the books of every token and is not covered by a book lock. The
+// row is created first so that there is always something to lock.
+func (r *TokenRepository) GetCashBalance(tx *sql.Tx, userID uint) (*big.Int, error) {
+	_, err := tx.Exec(`INSERT IGNORE INTO cash_balances (userID, amount) VALUES (?, 0)`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cash balance: %w", err)
+	}
+
+	query := `SELECT amount FROM cash_balances WHERE userID = ? FOR UPDATE`
+	var amountStr string
+	err = tx.QueryRow(query, userID).Scan(&amountStr)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cash balance: %w", err)
+	}
+
+	amount, ok := new(big.Int).SetString(amountStr, 10)
+	if !ok {
+		return nil, fmt.Errorf("error parsing cash balance amount")
+	}
+
+	return amount, nil
+}
+
+func (r *TokenRepository) GetMarketRules(tx *sql.Tx, tokenID uint) (*types.MarketRules, error) {
+	query := `SELECT tickSize, lotSize, minQuantity, maxQuantity, minNotional FROM tokens WHERE id = ?`
+	var tickSize, lotSize, minQuantity, maxQuantity, minNotional sql.NullString
+	err := tx.QueryRow(query, tokenID).Scan(&tickSize, &lotSize, &minQuantity, &maxQuantity, &minNotional)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("token not found")
+		}
+		return nil, fmt.Errorf("error getting market rules: %w", err)
+	}
+
+	return &types.MarketRules{
+		TokenID:     tokenID,
+		TickSize:    scanAmount(tickSize),
+		LotSize:     scanAmount(lotSize),
+		MinQuantity: scanAmount(minQuantity),
+		MaxQuantity: scanAmount(maxQuantity),
+		MinNotional: scanAmount(minNotional),
+	}, nil
+}
+
+func (r *TokenRepository) UpdateMarketRules(tx *sql.Tx, rules *types.MarketRules) error {
+	var maxQuantity any
+	if rules.MaxQuantity != nil {
+		maxQuantity = rules.MaxQuantity.String()
+	}
+
+	query := `UPDATE tokens SET tickSize = ?, lotSize = ?, minQuantity = ?, maxQuantity = ?, minNotional = ? WHERE id = ?`
+	_, err := tx.Exec(query, rules.TickSize.String(), rules.LotSize.String(), rules.MinQuantity.String(),
+		maxQuantity, rules.MinNotional.String(), rules.TokenID)
+	if err != nil {
+		return fmt.Errorf("error updating market rules: %w", err)
+	}
+	return nil
+}
+
+const auctionColumns = `id, tokenID, startsAt, endsAt, status, price, volume, createdAt, kind`
+
+func scanAuction(row rowScanner) (*types.Auction, error) {
+	var auction types.Auction
+	var price, volume sql.NullString
+	err := row.Scan(&auction.ID, &auction.TokenID, &auction.StartsAt, &auction.EndsAt, &auction.Status,
+		&price, &volume, &auction.CreatedAt, &auction.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	auction.Price = scanAmount(price)
+	auction.Volume = scanAmount(volume)
+	return &auction, nil
+}
+
+func (r *TokenRepository) CreateAuction(tx *sql.Tx, auction *types.Auction) error {
+	query := `INSERT INTO auctions (tokenID, kind, startsAt, endsAt, status) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, auction.TokenID, auction.Kind, auction.StartsAt, auction.EndsAt, auction.Status)
+	if err != nil {
+		return fmt.Errorf("error creating auction: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert ID: %w", err)
+	}
+
+	auction.ID = uint(id)
+	return nil
+}
+
+func (r *TokenRepository) GetAuctionByID(tx *sql.Tx, id uint) (*types.Auction, error) {
+	query := `SELECT ` + auctionColumns + ` FROM auctions WHERE id = ?`
+	auction, err := scanAuction(tx.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("auction not found")
+		}
+		return nil, fmt.Errorf("error getting auction: %w", err)
+	}
+	return auction, nil
+}
+
+// GetNextAuction returns the token's earliest auction that has not uncrossed
+// yet, whether or not it has started, or nil if there is none
+func (r *TokenRepository) GetNextAuction(tx *sql.Tx, tokenID uint) (*types.Auction, error) {
+	query := `SELECT ` + auctionColumns + `
+              FROM auctions
+              WHERE tokenID = ? AND status = 'scheduled'
+              ORDER BY startsAt ASC
+              LIMIT 1`
+	auction, err := scanAuction(tx.QueryRow(query, tokenID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting next auction: %w", err)
+	}
+	return auction, nil
+}
+
+// GetLastAuction returns the token's latest auction to have uncrossed, or nil
+// if there is none
+func (r *TokenRepository) GetLastAuction(tx *sql.Tx, tokenID uint) (*types.Auction, error) {
+	query := `SELECT ` + auctionColumns + `
+              FROM auctions
+              WHERE tokenID = ? AND status = 'uncrossed'
+              ORDER BY endsAt DESC, id DESC
+              LIMIT 1`
+	auction, err := scanAuction(tx.QueryRow(query, tokenID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting last auction: %w", err)
+	}
+	return auction, nil
+}
+
+// GetDueAuctions returns auctions that had ended by now but not uncrossed yet,
+// earliest end first
+func (r *TokenRepository) GetDueAuctions(tx *sql.Tx, now time.Time, limit int) ([]*types.Auction, error) {
+	query := `SELECT ` + auctionColumns + `
+              FROM auctions
+              WHERE status = 'scheduled' AND endsAt <= ?
+              ORDER BY endsAt ASC, id ASC
+              LIMIT ?`
+	rows, err := tx.Query(query, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting due auctions: %w", err)
+	}
+	defer rows.Close()
+
+	var auctions []*types.Auction
+	for rows.Next() {
+		auction, err := scanAuction(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning auction: %w", err)
+		}
+		auctions = append(auctions, auction)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating auctions: %w", err)
+	}
+
+	return auctions, nil
+}
+
+// HasOverlappingAuction reports whether the token has an auction that has not
+// uncrossed yet and runs at any point between startsAt and endsAt
+func (r *TokenRepository) HasOverlappingAuction(tx *sql.Tx, tokenID uint, startsAt, endsAt time.Time) (bool, error) {
+	query := `SELECT COUNT(*) FROM auctions WHERE tokenID = ? AND status = 'scheduled' AND startsAt < ? AND endsAt > ?`
+	var count int
+	if err := tx.QueryRow(query, tokenID, endsAt, startsAt).Scan(&count); err != nil {
+		return false, fmt.Errorf("error checking auction schedule: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (r *TokenRepository) FinishAuction(tx *sql.Tx, auction *types.Auction) error {
+	var price, volume any
+	if auction.Price != nil {
+		price = auction.Price.String()
+	}
+	if auction.Volume != nil {
+		volume = auction.Volume.String()
+	}
+
+	query := `UPDATE auctions SET status = ?, price = ?, volume = ? WHERE id = ?`
+	if _, err := tx.Exec(query, auction.Status, price, volume, auction.ID); err != nil {
+		return fmt.Errorf("error finishing auction: %w", err)
+	}
+	return nil
+}
+
+func scanAmount(amount sql.NullString) *big.Int {
+	if !amount.Valid {
+		return nil
+	}
+	value, _ := new(big.Int).SetString(amount.String, 10)
+	return value
+}
+
+func nullableString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
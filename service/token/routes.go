@@ -7,13 +7,13 @@ import (
 	"math/big"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/dawumnam/token-trader/db"
-	"github.com/dawumnam/token-trader/service/token/blockchain"
 	"github.com/dawumnam/token-trader/service/user/auth"
 	"github.com/dawumnam/token-trader/types"
 	"github.com/dawumnam/token-trader/utils"
-	"github.com/google/uuid"
+	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 )
 
@@ -21,16 +21,20 @@ type Handler struct {
 	userRepo  types.UserRepository
 	tokenRepo types.TokenRepository
 	txManager *db.TxManager
+	deployer  *Deployer
 }
 
-func NewHandler(tokenRepo types.TokenRepository, userRepo types.UserRepository, txManager *db.TxManager) *Handler {
-	return &Handler{tokenRepo: tokenRepo, txManager: txManager, userRepo: userRepo}
+func NewHandler(tokenRepo types.TokenRepository, userRepo types.UserRepository, txManager *db.TxManager, deployer *Deployer) *Handler {
+	return &Handler{tokenRepo: tokenRepo, txManager: txManager, userRepo: userRepo, deployer: deployer}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/token/issue", auth.WithJWTAuth(h.handleIssueToken, h.userRepo)).Methods("POST")
+	router.HandleFunc("/token/status/{tokenId}", auth.WithJWTAuth(h.handleGetTokenStatus, h.userRepo)).Methods("GET")
 	router.HandleFunc("/token/balance/{tokenId}", auth.WithJWTAuth(h.handleGetBalance, h.userRepo)).Methods("GET")
 	router.HandleFunc("/token/list", auth.WithJWTAuth(h.handleListTokens, h.userRepo)).Methods("GET")
+	router.HandleFunc("/cash/balance", auth.WithJWTAuth(h.handleGetCashBalance, h.userRepo)).Methods("GET")
+	router.HandleFunc("/cash/deposit", auth.WithJWTAuth(h.handleDepositCash, h.userRepo)).Methods("POST")
 }
 
 func (h *Handler) handleIssueToken(w http.ResponseWriter, r *http.Request) {
@@ -47,50 +51,69 @@ func (h *Handler) handleIssueToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var newToken *types.Token
-	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
-		newToken = &types.Token{
-			Name:            payload.Name,
-			Symbol:          payload.Symbol,
-			ContractAddress: uuid.New().String(),
-			OwnerID:         uint(userID),
-		}
+	if payload.OpeningAuctionSeconds < 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid opening auction length"))
+		return
+	}
 
-		tokenManager, err := blockchain.NewTokenManager()
-		if err != nil {
+	newToken := &types.Token{
+		Name:          payload.Name,
+		Symbol:        payload.Symbol,
+		OwnerID:       uint(userID),
+		InitialSupply: initialSupply,
+		Status:        "pending",
+	}
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		if err := h.tokenRepo.CreateToken(tx, newToken); err != nil {
 			return err
 		}
 
-		_, err = tokenManager.DeployToken(
-			types.IssueTokenPayload{
-				Name:          payload.Name,
-				Symbol:        payload.Symbol,
-				InitialSupply: payload.InitialSupply,
-			},
-		)
-		if err != nil {
-			return err
+		if payload.OpeningAuctionSeconds == 0 {
+			return nil
 		}
+		now := time.Now()
+		return h.tokenRepo.CreateAuction(tx, &types.Auction{
+			TokenID:  newToken.ID,
+			Kind:     "opening",
+			StartsAt: now,
+			EndsAt:   now.Add(time.Duration(payload.OpeningAuctionSeconds) * time.Second),
+			Status:   "scheduled",
+		})
+	})
 
-		err = h.tokenRepo.CreateToken(tx, newToken)
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to issue token: %v", err))
+		return
+	}
 
-		err = h.tokenRepo.UpdateTokenBalance(tx, uint(userID), newToken.ID, initialSupply)
-		if err != nil {
-			return err
-		}
+	// the contract is deployed in the background and the owner is credited
+	// with the initial supply once it is mined
+	h.deployer.Enqueue(newToken.ID)
 
-		return nil
+	utils.WriteJSON(w, http.StatusCreated, newToken)
+}
+
+func (h *Handler) handleGetTokenStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, err := strconv.ParseInt(vars["tokenId"], 10, 32)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid token ID"))
+		return
+	}
+
+	var token *types.Token
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		token, err = h.tokenRepo.GetTokenByID(tx, uint(tokenID))
+		return err
 	})
 
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to issue token: %v", err))
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get token: %v", err))
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, newToken)
+	utils.WriteJSON(w, http.StatusOK, token)
 }
 
 func (h *Handler) handleGetBalance(w http.ResponseWriter, r *http.Request) {
@@ -135,3 +158,78 @@ func (h *Handler) handleListTokens(w http.ResponseWriter, r *http.Request) {
 
 	utils.WriteJSON(w, http.StatusOK, tokens)
 }
+
+func (h *Handler) handleGetCashBalance(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var balance *big.Int
+	err := h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		balance, err = h.tokenRepo.GetCashBalance(tx, uint(userID))
+		return err
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get cash balance: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"balance": balance.String()})
+}
+
+// handleDepositCash credits the platform cash ledger that buyers pay for
+// trades with. Only admins may credit it, once a user's payment has cleared
+// with the payment provider; users can never fund themselves.
+func (h *Handler) handleDepositCash(w http.ResponseWriter, r *http.Request) {
+	caller, err := h.userRepo.GetUserById(r.Context().Value("userID").(int))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %v", err))
+		return
+	}
+	if !caller.IsAdmin {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied"))
+		return
+	}
+
+	var payload types.DepositCashPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	amount, ok := new(big.Int).SetString(payload.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid amount"))
+		return
+	}
+
+	if _, err := h.userRepo.GetUserById(int(payload.UserID)); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+
+	var balance *big.Int
+	err = h.txManager.RunInTransaction(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		balance, err = h.tokenRepo.GetCashBalance(tx, payload.UserID)
+		if err != nil {
+			return err
+		}
+
+		balance.Add(balance, amount)
+		return h.tokenRepo.UpdateCashBalance(tx, payload.UserID, balance)
+	})
+
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to deposit cash: %v", err))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"balance": balance.String()})
+}
@@ -2,7 +2,9 @@ package token
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -10,11 +12,15 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/dawumnam/token-trader/config"
 	"github.com/dawumnam/token-trader/db"
+	"github.com/dawumnam/token-trader/service/token/blockchain"
 	"github.com/dawumnam/token-trader/service/user"
 	"github.com/dawumnam/token-trader/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -23,6 +29,8 @@ import (
 var testDB *sql.DB
 var tokenHandler *Handler
 var userHandler *user.Handler
+var testDeployer *Deployer
+var testTokenManager types.TokenManager
 
 func TestMain(m *testing.M) {
 	cfg := config.Envs
@@ -45,14 +53,36 @@ func TestMain(m *testing.M) {
 	db.InitDatabase(testDB)
 	db.Init()
 
+	// a fresh key per run keeps contract addresses from colliding with the
+	// tokens that earlier runs left in the database
+	chainKey, err := crypto.GenerateKey()
+	if err != nil {
+		fmt.Printf("Failed to generate chain key: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.ChainBackend = "simulated"
+	cfg.ChainPrivateKey = hex.EncodeToString(crypto.FromECDSA(chainKey))
+	tokenManager, err := blockchain.NewTokenManager(cfg)
+	if err != nil {
+		fmt.Printf("Failed to start simulated chain: %v\n", err)
+		os.Exit(1)
+	}
+
 	tokenRepo := NewTokenRepository(testDB)
 	userRepo := user.NewRepository(testDB)
 	txManager := db.NewTxManager(testDB)
 
-	tokenHandler = NewHandler(tokenRepo, userRepo, txManager)
+	testTokenManager = tokenManager
+	testDeployer = NewDeployer(tokenRepo, txManager, tokenManager)
+	ctx, stopDeployer := context.WithCancel(context.Background())
+	go testDeployer.Run(ctx)
+
+	tokenHandler = NewHandler(tokenRepo, userRepo, txManager, testDeployer)
 	userHandler = user.NewHandler(userRepo)
 
 	code := m.Run()
+	stopDeployer()
+	tokenManager.Close()
 	testDB.Close()
 	os.Exit(code)
 }
@@ -125,11 +155,249 @@ func TestHandleIssueToken(t *testing.T) {
 		t.Fatalf("Failed to unmarshal response: %v", err)
 	}
 
-	if response.Name != payload.Name || response.Symbol != payload.Symbol {
+	if response.Name != payload.Name || response.Symbol != payload.Symbol || response.Status != "pending" {
 		t.Errorf("Handler returned unexpected body: %+v", response)
 	}
 }
 
+func waitForDeployment(t *testing.T, token string, tokenID uint) types.Token {
+	router := mux.NewRouter()
+	tokenHandler.RegisterRoutes(router)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/token/status/%d", tokenID), nil)
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+
+		var response types.Token
+		err := json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+
+		if response.Status != "pending" && response.Status != "deploying" {
+			return response
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Token %d was not deployed in time", tokenID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHandleGetTokenStatus(t *testing.T) {
+	_, token := createRandomUser(t)
+
+	body, _ := json.Marshal(types.IssueTokenPayload{
+		Name:          "Status Test Token",
+		Symbol:        "STT",
+		InitialSupply: "1000",
+	})
+	req, _ := http.NewRequest("POST", "/token/issue", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	tokenHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	var issuedToken types.Token
+	err := json.Unmarshal(rr.Body.Bytes(), &issuedToken)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	deployed := waitForDeployment(t, token, issuedToken.ID)
+	if deployed.Status != "deployed" {
+		t.Fatalf("Unexpected status: got %v want %v (%s)", deployed.Status, "deployed", deployed.DeployError)
+	}
+	if !common.IsHexAddress(deployed.ContractAddress) || deployed.DeployTxHash == "" || deployed.BlockNumber == 0 {
+		t.Errorf("Deployment was not recorded: %+v", deployed)
+	}
+}
+
+func TestDeployerResumesRecordedDeployment(t *testing.T) {
+	user, _ := createRandomUser(t)
+	var ownerID uint
+	if err := testDB.QueryRow("SELECT id FROM users WHERE email = ?", user.Email).Scan(&ownerID); err != nil {
+		t.Fatalf("Failed to look up user: %v", err)
+	}
+
+	tokenRepo := NewTokenRepository(testDB)
+	txManager := db.NewTxManager(testDB)
+
+	// records a signed deployment the way deploy does, and sends it only if
+	// send is set, as if the deployer had stopped right after recording it
+	recordDeployment := func(send bool) (*types.Token, string, string) {
+		token := &types.Token{
+			Name:          "Resumed Token",
+			Symbol:        "RST",
+			OwnerID:       ownerID,
+			InitialSupply: big.NewInt(500),
+			Status:        "pending",
+		}
+		err := txManager.RunInTransaction(context.Background(), func(tx *sql.Tx) error {
+			return tokenRepo.CreateToken(tx, token)
+		})
+		if err != nil {
+			t.Fatalf("Failed to create token: %v", err)
+		}
+
+		var contractAddress, txHash string
+		err = testTokenManager.DeployToken(context.Background(), types.IssueTokenPayload{
+			Name:          token.Name,
+			Symbol:        token.Symbol,
+			InitialSupply: token.InitialSupply.String(),
+		}, func(address, hash string, rawTx []byte) (bool, error) {
+			contractAddress, txHash = address, hash
+			var recorded bool
+			err := txManager.RunInTransaction(context.Background(), func(tx *sql.Tx) error {
+				var err error
+				recorded, err = tokenRepo.SetTokenDeployTx(tx, token.ID, address, hash, rawTx)
+				return err
+			})
+			return recorded && send, err
+		})
+		if err != nil || txHash == "" {
+			t.Fatalf("Failed to record deployment: %v", err)
+		}
+		return token, contractAddress, txHash
+	}
+
+	for _, sent := range []bool{false, true} {
+		token, contractAddress, txHash := recordDeployment(sent)
+
+		if err := testDeployer.deploy(context.Background(), token.ID); err != nil {
+			t.Fatalf("Failed to resume deployment (sent: %v): %v", sent, err)
+		}
+
+		var deployed *types.Token
+		var balance *big.Int
+		err := txManager.RunInTransaction(context.Background(), func(tx *sql.Tx) error {
+			var err error
+			if deployed, err = tokenRepo.GetTokenByID(tx, token.ID); err != nil {
+				return err
+			}
+			balance, err = tokenRepo.GetTokenBalance(tx, ownerID, token.ID)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Failed to get token: %v", err)
+		}
+
+		if deployed.Status != "deployed" {
+			t.Fatalf("Unexpected status (sent: %v): got %v want %v (%s)", sent, deployed.Status, "deployed", deployed.DeployError)
+		}
+		if deployed.ContractAddress != contractAddress || deployed.DeployTxHash != txHash {
+			t.Errorf("Deployment was signed again (sent: %v): got %s/%s want %s/%s",
+				sent, deployed.ContractAddress, deployed.DeployTxHash, contractAddress, txHash)
+		}
+		if balance.Cmp(token.InitialSupply) != 0 {
+			t.Errorf("Unexpected balance (sent: %v): got %v want %v", sent, balance, token.InitialSupply)
+		}
+	}
+}
+
+func TestDeployerFailsDeploymentUnknownToChain(t *testing.T) {
+	user, _ := createRandomUser(t)
+	var ownerID uint
+	if err := testDB.QueryRow("SELECT id FROM users WHERE email = ?", user.Email).Scan(&ownerID); err != nil {
+		t.Fatalf("Failed to look up user: %v", err)
+	}
+
+	tokenRepo := NewTokenRepository(testDB)
+	txManager := db.NewTxManager(testDB)
+
+	// recorded before signed deployments were kept, so only waited on
+	token := &types.Token{Name: "Lost Token", Symbol: "LST", OwnerID: ownerID, InitialSupply: big.NewInt(500), Status: "pending"}
+	key, _ := crypto.GenerateKey()
+	err := txManager.RunInTransaction(context.Background(), func(tx *sql.Tx) error {
+		if err := tokenRepo.CreateToken(tx, token); err != nil {
+			return err
+		}
+		_, err := tokenRepo.SetTokenDeployTx(tx, token.ID, crypto.PubkeyToAddress(key.PublicKey).Hex(), common.BytesToHash(crypto.FromECDSA(key)).Hex(), nil)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to record deployment: %v", err)
+	}
+
+	if err := testDeployer.deploy(context.Background(), token.ID); err != nil {
+		t.Fatalf("Failed to finish deployment: %v", err)
+	}
+
+	var failed *types.Token
+	err = txManager.RunInTransaction(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		failed, err = tokenRepo.GetTokenByID(tx, token.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if failed.Status != "failed" || failed.DeployError == "" {
+		t.Errorf("Unexpected token state: status %v, error %q", failed.Status, failed.DeployError)
+	}
+}
+
+func TestDeployTokenKeepsItsNonceUntilSent(t *testing.T) {
+	transferred := make(chan error, 1)
+	var txHash string
+	err := testTokenManager.DeployToken(context.Background(), types.IssueTokenPayload{
+		Name:          "Nonce Token",
+		Symbol:        "NNC",
+		InitialSupply: "100",
+	}, func(contractAddress, hash string, rawTx []byte) (bool, error) {
+		txHash = hash
+		// settlement sending from the platform's account while the
+		// deployment is being recorded
+		go func() {
+			_, err := testTokenManager.TransferToken(context.Background(), contractAddress, testTokenManager.Address(), big.NewInt(1))
+			transferred <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to deploy token: %v", err)
+	}
+	if err := <-transferred; err != nil {
+		t.Fatalf("Failed to transfer: %v", err)
+	}
+
+	if _, err := testTokenManager.WaitMined(context.Background(), txHash); err != nil {
+		t.Errorf("Deployment was not mined: %v", err)
+	}
+}
+
+func TestDeployTokenStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	recorded := false
+	err := testTokenManager.DeployToken(ctx, types.IssueTokenPayload{
+		Name:          "Cancelled Token",
+		Symbol:        "CNC",
+		InitialSupply: "100",
+	}, func(contractAddress, hash string, rawTx []byte) (bool, error) {
+		recorded = true
+		return true, nil
+	})
+	if err == nil {
+		t.Fatal("Expected a cancelled deployment to fail")
+	}
+	if recorded {
+		t.Error("Expected a cancelled deployment not to be recorded")
+	}
+}
+
 func TestHandleGetBalance(t *testing.T) {
 	_, token := createRandomUser(t)
 
@@ -155,6 +423,8 @@ func TestHandleGetBalance(t *testing.T) {
 		t.Fatalf("Failed to unmarshal response: %v", err)
 	}
 
+	waitForDeployment(t, token, issuedToken.ID)
+
 	req, _ = http.NewRequest("GET", fmt.Sprintf("/token/balance/%d", issuedToken.ID), nil)
 	req.Header.Set("Authorization", token)
 	rr = httptest.NewRecorder()
@@ -229,3 +499,106 @@ func TestHandleListTokens(t *testing.T) {
 		t.Errorf("Unexpected number of tokens: got %v want %v", len(tokens), 2)
 	}
 }
+
+func TestHandleDepositCash(t *testing.T) {
+	user, token := createRandomUser(t)
+	admin, adminToken := createRandomUser(t)
+	if _, err := testDB.Exec("UPDATE users SET isAdmin = TRUE WHERE email = ?", admin.Email); err != nil {
+		t.Fatalf("Failed to make user an admin: %v", err)
+	}
+
+	var userID uint
+	if err := testDB.QueryRow("SELECT id FROM users WHERE email = ?", user.Email).Scan(&userID); err != nil {
+		t.Fatalf("Failed to get user ID: %v", err)
+	}
+
+	router := mux.NewRouter()
+	tokenHandler.RegisterRoutes(router)
+
+	deposit := func(token string, userID uint) int {
+		body, _ := json.Marshal(types.DepositCashPayload{UserID: userID, Amount: "500"})
+		req, _ := http.NewRequest("POST", "/cash/deposit", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := deposit(token, userID); status != http.StatusForbidden {
+		t.Errorf("Expected users to be unable to fund themselves, got status %v", status)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := deposit(adminToken, userID); status != http.StatusOK {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+	}
+
+	if status := deposit(adminToken, 1<<31); status != http.StatusNotFound {
+		t.Errorf("Expected a deposit for an unknown user to fail, got status %v", status)
+	}
+
+	req, _ := http.NewRequest("GET", "/cash/balance", nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var balanceResponse map[string]string
+	err := json.Unmarshal(rr.Body.Bytes(), &balanceResponse)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if balanceResponse["balance"] != "1000" {
+		t.Errorf("Unexpected cash balance: got %v want %v", balanceResponse["balance"], "1000")
+	}
+}
+
+func TestHandleIssueTokenWithOpeningAuction(t *testing.T) {
+	_, token := createRandomUser(t)
+
+	payload := types.IssueTokenPayload{
+		Name:                  "Test Token",
+		Symbol:                "TST",
+		InitialSupply:         "1000",
+		OpeningAuctionSeconds: 600,
+	}
+
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", "/token/issue", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	tokenHandler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	var response types.Token
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	tx, err := testDB.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	auction, err := NewTokenRepository(testDB).GetNextAuction(tx, response.ID)
+	if err != nil {
+		t.Fatalf("Failed to get auction: %v", err)
+	}
+	if auction == nil || auction.Status != "scheduled" || auction.EndsAt.Sub(auction.StartsAt) != 600*time.Second {
+		t.Errorf("Unexpected opening auction: %+v", auction)
+	}
+}
@@ -16,13 +16,19 @@ func NewRepository(db *sql.DB) *Repository {
 }
 
 func (s *Repository) GetUserByEmail(email string) (*types.User, error) {
-	query := "SELECT id, firstName, lastName, email, password FROM users WHERE email=?"
+	query := "SELECT id, firstName, lastName, email, walletAddress, walletVerified, walletNonce, selfTradePrevention, isAdmin, password FROM users WHERE email=?"
 	var user types.User
+	var walletAddress, walletNonce sql.NullString
 	err := s.db.QueryRow(query, email).Scan(
 		&user.ID,
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&walletAddress,
+		&user.WalletVerified,
+		&walletNonce,
+		&user.SelfTradePrevention,
+		&user.IsAdmin,
 		&user.Password,
 	)
 
@@ -33,18 +39,26 @@ func (s *Repository) GetUserByEmail(email string) (*types.User, error) {
 		return nil, err
 	}
 
+	user.WalletAddress = walletAddress.String
+	user.WalletNonce = walletNonce.String
 	return &user, nil
 }
 
 func (s *Repository) GetUserById(id int) (*types.User, error) {
-	query := "SELECT id, firstName, lastName, email, password FROM users WHERE id=?;"
+	query := "SELECT id, firstName, lastName, email, walletAddress, walletVerified, walletNonce, selfTradePrevention, isAdmin, password FROM users WHERE id=?;"
 
 	var user types.User
+	var walletAddress, walletNonce sql.NullString
 	err := s.db.QueryRow(query, id).Scan(
 		&user.ID,
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&walletAddress,
+		&user.WalletVerified,
+		&walletNonce,
+		&user.SelfTradePrevention,
+		&user.IsAdmin,
 		&user.Password,
 	)
 
@@ -55,11 +69,18 @@ func (s *Repository) GetUserById(id int) (*types.User, error) {
 		return nil, err
 	}
 
+	user.WalletAddress = walletAddress.String
+	user.WalletNonce = walletNonce.String
 	return &user, nil
 }
 
 func (s *Repository) CreateUser(u *types.User) error {
-	result, err := s.db.Exec("INSERT INTO users (firstName, lastName, email, password) VALUES (?,?,?,?)", u.FirstName, u.LastName, u.Email, u.Password)
+	var walletAddress any
+	if u.WalletAddress != "" {
+		walletAddress = u.WalletAddress
+	}
+
+	result, err := s.db.Exec("INSERT INTO users (firstName, lastName, email, walletAddress, password) VALUES (?,?,?,?,?)", u.FirstName, u.LastName, u.Email, walletAddress, u.Password)
 
 	if err != nil {
 		return err
@@ -73,3 +94,47 @@ func (s *Repository) CreateUser(u *types.User) error {
 	u.ID = int(id)
 	return nil
 }
+
+// SetWalletNonce replaces the nonce the user's next wallet signature must sign
+func (s *Repository) SetWalletNonce(userID int, nonce string) error {
+	_, err := s.db.Exec("UPDATE users SET walletNonce=? WHERE id=?", nonce, userID)
+	if err != nil {
+		return fmt.Errorf("error setting wallet nonce: %w", err)
+	}
+	return nil
+}
+
+// LinkWallet sets the user's verified wallet and uses up nonce. It reports
+// false if nonce is no longer the user's current one.
+func (s *Repository) LinkWallet(userID int, walletAddress, nonce string) (bool, error) {
+	result, err := s.db.Exec("UPDATE users SET walletAddress=?, walletVerified=TRUE, walletNonce=NULL WHERE id=? AND walletNonce=?", walletAddress, userID, nonce)
+	if err != nil {
+		return false, fmt.Errorf("error linking wallet: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error getting rows affected: %w", err)
+	}
+	return updated == 1, nil
+}
+
+// HasUnfinishedTransfers reports whether settlement still has transfers from
+// or to the user that have not reached a final state
+func (s *Repository) HasUnfinishedTransfers(userID int) (bool, error) {
+	query := `SELECT COUNT(*) FROM settlement_transfers
+              WHERE (fromUserID=? OR toUserID=?) AND status IN ('pending', 'submitting', 'submitted')`
+	var count int
+	if err := s.db.QueryRow(query, userID, userID).Scan(&count); err != nil {
+		return false, fmt.Errorf("error checking unfinished transfers: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (s *Repository) UpdateSelfTradePrevention(userID int, mode string) error {
+	_, err := s.db.Exec("UPDATE users SET selfTradePrevention=? WHERE id=?", mode, userID)
+	if err != nil {
+		return fmt.Errorf("error updating self-trade prevention: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package user
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"time"
@@ -10,6 +12,10 @@ import (
 	"github.com/dawumnam/token-trader/service/user/auth"
 	"github.com/dawumnam/token-trader/types"
 	"github.com/dawumnam/token-trader/utils"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/go-playground/validator/v10"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
@@ -27,6 +33,9 @@ func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/login", h.handleLogin).Methods("POST")
 	router.HandleFunc("/register", h.HandleRegister).Methods("POST")
 	router.HandleFunc("/logout", h.handleLogout).Methods("POST")
+	router.HandleFunc("/wallet/challenge", auth.WithJWTAuth(h.handleWalletChallenge, h.repository)).Methods("POST")
+	router.HandleFunc("/wallet", auth.WithJWTAuth(h.handleUpdateWallet, h.repository)).Methods("POST")
+	router.HandleFunc("/self-trade-prevention", auth.WithJWTAuth(h.handleUpdateSelfTradePrevention, h.repository)).Methods("POST")
 }
 
 func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -151,3 +160,127 @@ func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
 
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "Successfully logged out"})
 }
+
+// handleWalletChallenge issues the message a wallet must sign to be linked to
+// the user. Each challenge replaces the last and can be used once.
+func (h *Handler) handleWalletChallenge(w http.ResponseWriter, r *http.Request) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to create challenge: %v", err))
+		return
+	}
+
+	userID := auth.GetUserIdFromContext(r.Context())
+	if err := h.repository.SetWalletNonce(userID, hex.EncodeToString(nonce)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": walletChallenge(hex.EncodeToString(nonce))})
+}
+
+// handleUpdateWallet sets the address that settlement sends the user's tokens
+// to and takes them from onchain, once the wallet has signed the user's
+// challenge. The wallet cannot change while settlement may still be moving
+// tokens from or to the old one.
+func (h *Handler) handleUpdateWallet(w http.ResponseWriter, r *http.Request) {
+	var payload types.UpdateWalletPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	userID := auth.GetUserIdFromContext(r.Context())
+	user, err := h.repository.GetUserById(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if user.WalletNonce == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("no wallet challenge issued"))
+		return
+	}
+
+	signer, err := recoverSigner(walletChallenge(user.WalletNonce), payload.Signature)
+	if err != nil || signer != common.HexToAddress(payload.WalletAddress) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("signature does not match the wallet"))
+		return
+	}
+
+	unfinished, err := h.repository.HasUnfinishedTransfers(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if unfinished {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("wallet cannot change while transfers are being settled"))
+		return
+	}
+
+	linked, err := h.repository.LinkWallet(userID, payload.WalletAddress, user.WalletNonce)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !linked {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("wallet challenge already used"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"walletAddress": payload.WalletAddress})
+}
+
+// handleUpdateSelfTradePrevention sets what happens by default when the user's
+// own orders would trade with each other
+func (h *Handler) handleUpdateSelfTradePrevention(w http.ResponseWriter, r *http.Request) {
+	var payload types.UpdateSelfTradePreventionPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload %v", errors))
+		return
+	}
+
+	userID := auth.GetUserIdFromContext(r.Context())
+	err := h.repository.UpdateSelfTradePrevention(userID, payload.Mode)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"selfTradePrevention": payload.Mode})
+}
+
+func walletChallenge(nonce string) string {
+	return fmt.Sprintf("Link this wallet to your token-trader account: %s", nonce)
+}
+
+// recoverSigner returns the address whose personal_sign signature of message
+// is signature
+func recoverSigner(message, signature string) (common.Address, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("invalid signature")
+	}
+
+	// wallets add 27 to the recovery ID
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	publicKey, err := crypto.SigToPub(accounts.TextHash([]byte(message)), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
@@ -2,9 +2,11 @@ package user
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -13,6 +15,9 @@ import (
 	"github.com/dawumnam/token-trader/config"
 	"github.com/dawumnam/token-trader/db"
 	"github.com/dawumnam/token-trader/types"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -155,3 +160,167 @@ func TestHandleLogout(t *testing.T) {
 		t.Errorf("Handler returned unexpected message: got %v want %v", message, "Successfully logged out")
 	}
 }
+
+// signWalletChallenge asks for a wallet challenge and signs it with key the way
+// a wallet's personal_sign would
+func signWalletChallenge(t *testing.T, router *mux.Router, token string, key *ecdsa.PrivateKey) string {
+	req, _ := http.NewRequest("POST", "/wallet/challenge", nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	signature, err := crypto.Sign(accounts.TextHash([]byte(response["message"])), key)
+	if err != nil {
+		t.Fatalf("Failed to sign challenge: %v", err)
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	return hexutil.Encode(signature)
+}
+
+func updateWallet(router *mux.Router, token string, payload types.UpdateWalletPayload) int {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", "/wallet", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestHandleUpdateWallet(t *testing.T) {
+	registerPayload := createRandomUser()
+
+	body, _ := json.Marshal(registerPayload)
+	req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	var registerResponse map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &registerResponse)
+	token := registerResponse["token"]
+
+	key, _ := crypto.GenerateKey()
+	walletAddress := crypto.PubkeyToAddress(key.PublicKey).Hex()
+
+	// someone else's address cannot be linked without its key
+	otherKey, _ := crypto.GenerateKey()
+	signature := signWalletChallenge(t, router, token, otherKey)
+	if status := updateWallet(router, token, types.UpdateWalletPayload{WalletAddress: walletAddress, Signature: signature}); status != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code for a foreign signature: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	signature = signWalletChallenge(t, router, token, key)
+	if status := updateWallet(router, token, types.UpdateWalletPayload{WalletAddress: walletAddress, Signature: signature}); status != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	u, err := handler.repository.GetUserByEmail(registerPayload.Email)
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if u.WalletAddress != walletAddress || !u.WalletVerified {
+		t.Errorf("Unexpected wallet: got %v (verified %v) want %v", u.WalletAddress, u.WalletVerified, walletAddress)
+	}
+
+	if status := updateWallet(router, token, types.UpdateWalletPayload{WalletAddress: walletAddress, Signature: signature}); status != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code for a reused challenge: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	if status := updateWallet(router, token, types.UpdateWalletPayload{WalletAddress: "not-an-address", Signature: signature}); status != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// a transfer still being settled pins the wallet
+	_, err = testDB.Exec("INSERT INTO tokens (name, symbol, ownerID, initialSupply, status) VALUES ('Wallet Token', 'WLT', ?, 100, 'deployed')", u.ID)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	result, err := testDB.Exec("INSERT INTO settlement_batches (fromTradeID, toTradeID) VALUES (0, ?)", rand.Uint32())
+	if err != nil {
+		t.Fatalf("Failed to create batch: %v", err)
+	}
+	batchID, _ := result.LastInsertId()
+	_, err = testDB.Exec(`INSERT INTO settlement_transfers (batchID, tokenID, fromUserID, toUserID, amount, status)
+                          SELECT ?, id, ?, ?, 10, 'submitted' FROM tokens WHERE ownerID = ?`, batchID, u.ID, u.ID, u.ID)
+	if err != nil {
+		t.Fatalf("Failed to create transfer: %v", err)
+	}
+
+	newKey, _ := crypto.GenerateKey()
+	signature = signWalletChallenge(t, router, token, newKey)
+	newAddress := crypto.PubkeyToAddress(newKey.PublicKey).Hex()
+	if status := updateWallet(router, token, types.UpdateWalletPayload{WalletAddress: newAddress, Signature: signature}); status != http.StatusConflict {
+		t.Errorf("Handler returned wrong status code with a transfer unfinished: got %v want %v", status, http.StatusConflict)
+	}
+}
+
+func TestHandleUpdateSelfTradePrevention(t *testing.T) {
+	registerPayload := createRandomUser()
+
+	body, _ := json.Marshal(registerPayload)
+	req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+	router.ServeHTTP(rr, req)
+
+	var registerResponse map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &registerResponse)
+	token := registerResponse["token"]
+
+	u, err := handler.repository.GetUserByEmail(registerPayload.Email)
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if u.SelfTradePrevention != "cancel_newest" {
+		t.Errorf("Unexpected default self-trade prevention: got %v want %v", u.SelfTradePrevention, "cancel_newest")
+	}
+
+	body, _ = json.Marshal(types.UpdateSelfTradePreventionPayload{Mode: "decrement"})
+	req, _ = http.NewRequest("POST", "/self-trade-prevention", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	u, err = handler.repository.GetUserByEmail(registerPayload.Email)
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if u.SelfTradePrevention != "decrement" {
+		t.Errorf("Unexpected self-trade prevention: got %v want %v", u.SelfTradePrevention, "decrement")
+	}
+
+	body, _ = json.Marshal(types.UpdateSelfTradePreventionPayload{Mode: "allow"})
+	req, _ = http.NewRequest("POST", "/self-trade-prevention", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
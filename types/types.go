@@ -1,41 +1,119 @@
 package types
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"math/big"
 	"time"
 )
 
+// ErrTransactionFailed is returned by TokenManager.WaitMined for a transaction
+// that will never succeed, because it reverted or the chain does not know it.
+// Any other error leaves its outcome open.
+var ErrTransactionFailed = errors.New("transaction failed")
+
 type UserRepository interface {
 	GetUserByEmail(email string) (*User, error)
 	GetUserById(id int) (*User, error)
 	CreateUser(*User) error
+	SetWalletNonce(userID int, nonce string) error
+	LinkWallet(userID int, walletAddress, nonce string) (bool, error)
+	HasUnfinishedTransfers(userID int) (bool, error)
+	UpdateSelfTradePrevention(userID int, mode string) error
 }
 
 type TokenRepository interface {
 	CreateToken(tx *sql.Tx, token *Token) error
 	GetTokenByID(tx *sql.Tx, id uint) (*Token, error)
 	GetTokensByOwner(tx *sql.Tx, ownerID uint) ([]*Token, error)
+	GetPendingTokens(tx *sql.Tx) ([]*Token, error)
+	SetTokenDeployTx(tx *sql.Tx, tokenID uint, contractAddress, txHash string, rawTx []byte) (bool, error)
+	FinishTokenDeployment(tx *sql.Tx, token *Token) (bool, error)
 	UpdateTokenBalance(tx *sql.Tx, userID, tokenID uint, amount *big.Int) error
 	GetTokenBalance(tx *sql.Tx, userID, tokenID uint) (*big.Int, error)
+	UpdateCashBalance(tx *sql.Tx, userID uint, amount *big.Int) error
+	GetCashBalance(tx *sql.Tx, userID uint) (*big.Int, error)
+	GetMarketRules(tx *sql.Tx, tokenID uint) (*MarketRules, error)
+	UpdateMarketRules(tx *sql.Tx, rules *MarketRules) error
+	CreateAuction(tx *sql.Tx, auction *Auction) error
+	GetAuctionByID(tx *sql.Tx, id uint) (*Auction, error)
+	GetNextAuction(tx *sql.Tx, tokenID uint) (*Auction, error)
+	GetLastAuction(tx *sql.Tx, tokenID uint) (*Auction, error)
+	GetDueAuctions(tx *sql.Tx, now time.Time, limit int) ([]*Auction, error)
+	HasOverlappingAuction(tx *sql.Tx, tokenID uint, startsAt, endsAt time.Time) (bool, error)
+	FinishAuction(tx *sql.Tx, auction *Auction) error
 }
 
 type OrderRepository interface {
 	CreateOrder(tx *sql.Tx, order *Order) error
 	GetOrderByID(tx *sql.Tx, id uint) (*Order, error)
+	GetOrderByClientID(tx *sql.Tx, userID uint, clientOrderID string) (*Order, error)
 	GetOpenOrders(tx *sql.Tx, tokenID uint, orderType string) ([]*Order, error)
+	GetExpiredOrders(tx *sql.Tx, limit int) ([]*Order, error)
+	GetWorkingOrders(tx *sql.Tx, userID, tokenID uint, orderType string) ([]*Order, error)
+	GetTriggeredOrders(tx *sql.Tx, tokenID uint, lastPrice *big.Int) ([]*Order, error)
+	ActivateOrder(tx *sql.Tx, order *Order) error
 	UpdateOrderStatus(tx *sql.Tx, orderID uint, status string) error
+	UpdateOrderFill(tx *sql.Tx, order *Order) error
+	AmendOrder(tx *sql.Tx, order *Order) error
+	RequeueOrder(tx *sql.Tx, orderID uint) error
+	LinkOrders(tx *sql.Tx, orderID, linkedOrderID uint) error
+	GetLinkedOrderID(tx *sql.Tx, orderID uint) (uint, error)
+	LockOrderBook(tx *sql.Tx, tokenID uint) error
+	GetBookLevels(tx *sql.Tx, tokenID uint, orderType string, depth int) ([]*PriceLevel, error)
 	CreateTrade(tx *sql.Tx, trade *Trade) error
-	GetUserTrades(tx *sql.Tx, userID uint) ([]*Trade, error)
+	GetUserTrades(tx *sql.Tx, userID uint, filter TradeFilter) ([]*Trade, error)
+	GetUserOrders(tx *sql.Tx, userID uint, filter OrderFilter) ([]*Order, error)
+	GetFillSummaries(tx *sql.Tx, orderIDs []uint) (map[uint]*FillSummary, error)
+	GetRecentTrades(tx *sql.Tx, tokenID uint, afterSequence uint64, limit int) ([]*Trade, error)
+	GetLastTradePrice(tx *sql.Tx, tokenID uint) (*big.Int, error)
+	GetPendingSellAmount(tx *sql.Tx, userID, tokenID uint) (*big.Int, error)
+	GetTradePriceRange(tx *sql.Tx, tokenID uint, window time.Duration) (low, high *big.Int, err error)
+	GetTradingStatus(tx *sql.Tx, tokenID uint) (*TradingStatus, error)
+	HaltTrading(tx *sql.Tx, tokenID uint, reason string, duration time.Duration) error
+	ResumeTrading(tx *sql.Tx, tokenID uint) error
+}
+
+type SettlementRepository interface {
+	GetTradesToSettle(tx *sql.Tx, limit int) ([]*Trade, error)
+	CreateBatch(tx *sql.Tx, batch *SettlementBatch) error
+	AddTradesToBatch(tx *sql.Tx, batchID uint, tradeIDs []uint) error
+	CreateTransfer(tx *sql.Tx, transfer *SettlementTransfer) error
+	GetUnfinishedTransfers(tx *sql.Tx) ([]*SettlementTransfer, error)
+	UpdateTransfer(tx *sql.Tx, transfer *SettlementTransfer) error
+	CloseFinishedBatches(tx *sql.Tx) error
+}
+
+// TokenManager deploys and moves tokens on whichever chain backend is configured
+type TokenManager interface {
+	DeployToken(ctx context.Context, payload IssueTokenPayload, record func(contractAddress, txHash string, rawTx []byte) (bool, error)) error
+	SendTransaction(ctx context.Context, rawTx []byte) error
+	TransferToken(ctx context.Context, tokenAddress string, to string, amount *big.Int) (string, error)
+	TransferFrom(ctx context.Context, tokenAddress string, from string, to string, amount *big.Int) (string, error)
+	WaitMined(ctx context.Context, txHash string) (uint64, error)
+	GetBalance(tokenAddress string, address string) (*big.Int, error)
+	GetPlatformAddress(tokenAddress string) (string, error)
+	Address() string
+	Close()
 }
 
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"firstName"`
-	LastName  string    `json:"lastName"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID            int    `json:"id"`
+	FirstName     string `json:"firstName"`
+	LastName      string `json:"lastName"`
+	Email         string `json:"email"`
+	WalletAddress string `json:"walletAddress"` // empty while the platform holds the user's tokens onchain
+	// WalletVerified is set once the user has proven they own WalletAddress.
+	// Settlement ignores wallets that are not verified.
+	WalletVerified bool   `json:"walletVerified"`
+	WalletNonce    string `json:"-"`
+	// SelfTradePrevention is what happens by default when the user's orders
+	// would trade with each other
+	SelfTradePrevention string    `json:"selfTradePrevention"`
+	IsAdmin             bool      `json:"isAdmin"`
+	Password            string    `json:"-"`
+	CreatedAt           time.Time `json:"createdAt"`
 }
 
 type Token struct {
@@ -44,7 +122,48 @@ type Token struct {
 	Name            string    `json:"name"`
 	Symbol          string    `json:"symbol"`
 	OwnerID         uint      `json:"ownerId"`
+	InitialSupply   *big.Int  `json:"initialSupply"`
+	Status          string    `json:"status"` // "pending", "deploying", "deployed", or "failed"
+	DeployTxHash    string    `json:"deployTxHash,omitempty"`
+	BlockNumber     uint64    `json:"blockNumber,omitempty"`
+	DeployError     string    `json:"deployError,omitempty"`
 	CreatedAt       time.Time `json:"createdAt"`
+	// DeployRawTx is the signed deployment transaction, recorded before it is
+	// sent so that it can be sent again rather than signed anew
+	DeployRawTx []byte `json:"-"`
+}
+
+// MarketRules constrain the orders placed on a token's book. Prices must be
+// multiples of TickSize and amounts multiples of LotSize. MaxQuantity is nil
+// when there is no maximum.
+type MarketRules struct {
+	TokenID     uint     `json:"tokenId"`
+	TickSize    *big.Int `json:"tickSize"`
+	LotSize     *big.Int `json:"lotSize"`
+	MinQuantity *big.Int `json:"minQuantity"`
+	MaxQuantity *big.Int `json:"maxQuantity,omitempty"`
+	MinNotional *big.Int `json:"minNotional"`
+}
+
+// Auction is a call auction on a token's book. Between StartsAt and the uncross
+// that follows EndsAt, orders are collected without matching; the uncross then
+// trades them all at the single price that executes the most volume. After an
+// opening auction the book trades continuously, while after a closing auction
+// it goes on collecting orders until the next auction uncrosses.
+type Auction struct {
+	ID       uint      `json:"id"`
+	TokenID  uint      `json:"tokenId"`
+	Kind     string    `json:"kind"` // "opening" or "closing"
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+	Status   string    `json:"status"` // "scheduled" or "uncrossed"
+	Price    *big.Int  `json:"price,omitempty"`
+	Volume   *big.Int  `json:"volume,omitempty"`
+	// the price and volume the auction would uncross at right now, only
+	// published while it runs
+	IndicativePrice  *big.Int  `json:"indicativePrice,omitempty"`
+	IndicativeVolume *big.Int  `json:"indicativeVolume,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
 }
 
 type Balance struct {
@@ -55,25 +174,174 @@ type Balance struct {
 }
 
 type Order struct {
-	ID        uint      `json:"id"`
-	UserID    uint      `json:"userId"`
-	TokenID   uint      `json:"tokenId"`
-	OrderType string    `json:"orderType"` // "buy" or "sell"
-	Amount    *big.Int  `json:"amount"`
-	Price     *big.Int  `json:"price"`
-	Status    string    `json:"status"` // "open", "filled", or "cancelled"
-	CreatedAt time.Time `json:"createdAt"`
+	ID              uint       `json:"id"`
+	ClientOrderID   string     `json:"clientOrderId,omitempty"`
+	UserID          uint       `json:"userId"`
+	TokenID         uint       `json:"tokenId"`
+	OrderType       string     `json:"orderType"`   // "buy" or "sell"
+	Kind            string     `json:"kind"`        // "limit", "market", "stop", or "stop_limit"
+	TimeInForce     string     `json:"timeInForce"` // "GTC", "IOC", "FOK", or "GTD"
+	Amount          *big.Int   `json:"amount"`
+	FilledAmount    *big.Int   `json:"filledAmount"`
+	RemainingAmount *big.Int   `json:"remainingAmount"`
+	Price           *big.Int   `json:"price"`
+	TriggerPrice    *big.Int   `json:"triggerPrice,omitempty"` // set for stop and stop_limit orders
+	Status          string     `json:"status"`                 // "pending_trigger", "open", "partially_filled", "filled", or "cancelled"
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`    // set for GTD orders only
+	PostOnly        bool       `json:"postOnly"`
+	ReduceOnly      bool       `json:"reduceOnly"`
+	// DisplayAmount is how much of an iceberg order is shown at a time, and
+	// VisibleAmount how much of that is still showing. The rest of the
+	// remaining amount is hidden from the book.
+	DisplayAmount *big.Int `json:"displayAmount,omitempty"`
+	VisibleAmount *big.Int `json:"visibleAmount,omitempty"`
+	// SelfTradePrevention is what happens when the order would trade with
+	// another order of the same user: "cancel_newest", "cancel_oldest",
+	// "cancel_both", or "decrement"
+	SelfTradePrevention string    `json:"selfTradePrevention"`
+	CreatedAt           time.Time `json:"createdAt"`
+}
+
+// OrderFilter narrows down a user's orders, which are listed newest first.
+// Zero fields do not filter.
+type OrderFilter struct {
+	TokenID  uint
+	Statuses []string
+	From     *time.Time // by createdAt
+	To       *time.Time // exclusive
+	BeforeID uint       // only orders placed before this one
+	Limit    int
+}
+
+// FillSummary sums up the trades an order has made
+type FillSummary struct {
+	TradeCount   int        `json:"tradeCount"`
+	Notional     *big.Int   `json:"notional"`               // amount times price over all trades
+	AveragePrice *big.Int   `json:"averagePrice,omitempty"` // rounded down
+	LastFillAt   *time.Time `json:"lastFillAt,omitempty"`
+}
+
+type UserOrder struct {
+	*Order
+	Fills *FillSummary `json:"fills"`
+}
+
+// UserOrdersResponse is a page of a user's orders. NextCursor is passed as
+// the cursor to get the next page and is left out on the last page.
+type UserOrdersResponse struct {
+	Orders     []*UserOrder `json:"orders"`
+	NextCursor uint         `json:"nextCursor,omitempty"`
 }
 
 // Trade represents a completed trade between two users
 type Trade struct {
-	ID        uint      `json:"id"`
-	SellerID  uint      `json:"sellerId"`
-	BuyerID   uint      `json:"buyerId"`
-	TokenID   uint      `json:"tokenId"`
-	Amount    *big.Int  `json:"amount"`
-	Price     *big.Int  `json:"price"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID          uint      `json:"id"`
+	SellerID    uint      `json:"sellerId"`
+	BuyerID     uint      `json:"buyerId"`
+	BuyOrderID  uint      `json:"buyOrderId,omitempty"`  // 0 when the buyer took the order directly
+	SellOrderID uint      `json:"sellOrderId,omitempty"` // 0 when the seller took the order directly
+	TokenID     uint      `json:"tokenId"`
+	Amount      *big.Int  `json:"amount"`
+	Price       *big.Int  `json:"price"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Sequence counts the token's trades from 1. AggressorSide is the side of
+	// the order that took liquidity, and empty for trades of call auctions.
+	Sequence      uint64 `json:"sequence"`
+	AggressorSide string `json:"aggressorSide,omitempty"`
+}
+
+// TapeTrade is a trade as shown on a token's public tape, which leaves out
+// who traded
+type TapeTrade struct {
+	Sequence      uint64    `json:"sequence"`
+	TokenID       uint      `json:"tokenId"`
+	Amount        *big.Int  `json:"amount"`
+	Price         *big.Int  `json:"price"`
+	AggressorSide string    `json:"aggressorSide,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// UserTrade is a trade as seen by one of the two users in it
+type UserTrade struct {
+	*Trade
+	Role     string   `json:"role"`     // "buyer" or "seller"
+	Notional *big.Int `json:"notional"` // amount times price
+}
+
+// TradeFilter narrows down a user's trades, which are listed newest first.
+// Zero fields do not filter.
+type TradeFilter struct {
+	TokenID  uint
+	Side     string // "buy" or "sell"
+	From     *time.Time
+	To       *time.Time // exclusive
+	BeforeID uint       // only trades older than this one
+	Limit    int
+}
+
+// UserTradesResponse is a page of a user's trades. NextCursor is passed as
+// the cursor to get the next page and is left out on the last page.
+type UserTradesResponse struct {
+	Trades     []*UserTrade `json:"trades"`
+	NextCursor uint         `json:"nextCursor,omitempty"`
+}
+
+// PlaceOrderResponse is the placed order along with the trades it produced
+// when it crossed the book
+type PlaceOrderResponse struct {
+	*Order
+	Trades []*Trade `json:"trades"`
+}
+
+// PriceLevel is everything resting at one price on one side of a book
+type PriceLevel struct {
+	Price    *big.Int `json:"price"`
+	Quantity *big.Int `json:"quantity"`
+	Orders   int      `json:"orders"`
+}
+
+// OrderBook is the aggregated depth of a token's book, best prices first
+type OrderBook struct {
+	TokenID uint          `json:"tokenId"`
+	Bids    []*PriceLevel `json:"bids"`
+	Asks    []*PriceLevel `json:"asks"`
+}
+
+// TradingStatus tells whether trading on a token is halted, and if so why and
+// until when. ResumesAt is nil for halts that last until trading is resumed.
+type TradingStatus struct {
+	TokenID   uint       `json:"tokenId"`
+	Halted    bool       `json:"halted"`
+	Reason    string     `json:"reason,omitempty"`
+	HaltedAt  *time.Time `json:"haltedAt,omitempty"`
+	ResumesAt *time.Time `json:"resumesAt,omitempty"`
+}
+
+// SettlementBatch settles the trades linked to it. FromTradeID and ToTradeID
+// are the lowest and highest of their IDs, but trades that committed late may
+// fall between them and belong to a later batch.
+type SettlementBatch struct {
+	ID          uint       `json:"id"`
+	FromTradeID uint       `json:"fromTradeId"`
+	ToTradeID   uint       `json:"toTradeId"`
+	Status      string     `json:"status"` // "pending", "settled", or "failed"
+	CreatedAt   time.Time  `json:"createdAt"`
+	SettledAt   *time.Time `json:"settledAt"`
+}
+
+// SettlementTransfer is one net onchain token movement within a batch
+type SettlementTransfer struct {
+	ID          uint     `json:"id"`
+	BatchID     uint     `json:"batchId"`
+	TokenID     uint     `json:"tokenId"`
+	FromUserID  uint     `json:"fromUserId"`
+	ToUserID    uint     `json:"toUserId"`
+	Amount      *big.Int `json:"amount"`
+	FromAddress string   `json:"fromAddress"`
+	ToAddress   string   `json:"toAddress"`
+	TxHash      string   `json:"txHash"`
+	Status      string   `json:"status"` // "pending", "submitting", "submitted", "confirmed", "skipped", or "failed"
+	Error       string   `json:"error"`
 }
 
 type RegisterUserPayload struct {
@@ -88,33 +356,137 @@ type LoginUserPayload struct {
 	Password string `json:"password" validate:"required"`
 }
 
+// UpdateWalletPayload links a wallet to the user. Signature is the wallet's
+// personal_sign signature of the message from the user's latest wallet
+// challenge.
+type UpdateWalletPayload struct {
+	WalletAddress string `json:"walletAddress" validate:"required,eth_addr"`
+	Signature     string `json:"signature" validate:"required"`
+}
+
+type UpdateSelfTradePreventionPayload struct {
+	Mode string `json:"mode" validate:"required,oneof=cancel_newest cancel_oldest cancel_both decrement"`
+}
+
 type IssueTokenPayload struct {
 	Name          string `json:"name" validate:"required"`
 	Symbol        string `json:"symbol" validate:"required,max=10"`
 	InitialSupply string `json:"initialSupply" validate:"required"`
+	// OpeningAuctionSeconds opens the token's book with a call auction of
+	// that length
+	OpeningAuctionSeconds int64 `json:"openingAuctionSeconds,omitempty"`
+}
+
+type ScheduleAuctionPayload struct {
+	// Kind defaults to "opening"
+	Kind     string    `json:"kind" validate:"omitempty,oneof=opening closing"`
+	StartsAt time.Time `json:"startsAt" validate:"required"`
+	EndsAt   time.Time `json:"endsAt" validate:"required"`
+}
+
+type UpdateMarketRulesPayload struct {
+	TickSize    string `json:"tickSize" validate:"required"`
+	LotSize     string `json:"lotSize" validate:"required"`
+	MinQuantity string `json:"minQuantity" validate:"required"`
+	MaxQuantity string `json:"maxQuantity"` // no maximum if empty
+	MinNotional string `json:"minNotional" validate:"required"`
+}
+
+// DepositCashPayload credits a user's cash once their payment has cleared
+// with the payment provider
+type DepositCashPayload struct {
+	UserID uint   `json:"userId" validate:"required"`
+	Amount string `json:"amount" validate:"required"`
 }
 
 type PlaceOrderPayload struct {
-	TokenID   uint   `json:"tokenId" validate:"required"`
-	OrderType string `json:"orderType" validate:"required,oneof=buy sell"`
-	Amount    string `json:"amount" validate:"required"`
-	Price     string `json:"price" validate:"required"`
+	// ClientOrderID is the client's own ID for the order, unique per user.
+	// Placing an order again with the same ID returns the original order.
+	ClientOrderID string `json:"clientOrderId" validate:"omitempty,max=64"`
+	TokenID       uint   `json:"tokenId" validate:"required"`
+	OrderType     string `json:"orderType" validate:"required,oneof=buy sell"`
+	Kind          string `json:"kind" validate:"omitempty,oneof=limit market stop stop_limit"` // defaults to "limit"
+	Amount        string `json:"amount" validate:"required"`
+	Price         string `json:"price"` // required for limit and stop_limit orders
+	// TriggerPrice is the last trade price at which a stop or stop_limit order
+	// becomes a market or limit order: at or above it for buys, at or below it
+	// for sells
+	TriggerPrice string `json:"triggerPrice"`
+	// TimeInForce defaults to "GTC" for limit orders and "IOC" for market
+	// orders, which cannot rest on the book
+	TimeInForce string     `json:"timeInForce" validate:"omitempty,oneof=GTC IOC FOK GTD"`
+	ExpiresAt   *time.Time `json:"expiresAt"` // required for GTD orders
+	// MaxSlippageBps bounds how far from the best opposite price a market order
+	// may fill, in basis points. It defaults to the configured slippage.
+	MaxSlippageBps *int64 `json:"maxSlippageBps" validate:"omitempty,min=0,max=10000"`
+	// PostOnly orders are rejected rather than take liquidity, so they only
+	// ever rest on the book
+	PostOnly bool `json:"postOnly"`
+	// ReduceOnly sells, together with the user's other sells, can never sell
+	// more tokens than the user holds
+	ReduceOnly bool `json:"reduceOnly"`
+	// DisplayAmount makes a limit order an iceberg that only ever shows this
+	// much of its remaining amount on the book
+	DisplayAmount string `json:"displayAmount"`
+	// SelfTradePrevention defaults to the user's account setting
+	SelfTradePrevention string `json:"selfTradePrevention" validate:"omitempty,oneof=cancel_newest cancel_oldest cancel_both decrement"`
 }
 
-type ExecuteOrderPayload struct {
-	OrderID uint `json:"orderId" validate:"required"`
+// PlaceOCOPayload places a limit order and a stop order for the same amount as
+// a one-cancels-other pair: once either trades or the stop triggers, the other
+// is cancelled. Sells take profit above the trigger price and buys below it.
+type PlaceOCOPayload struct {
+	TokenID      uint   `json:"tokenId" validate:"required"`
+	OrderType    string `json:"orderType" validate:"required,oneof=buy sell"`
+	Amount       string `json:"amount" validate:"required"`
+	Price        string `json:"price" validate:"required"` // of the limit order
+	TriggerPrice string `json:"triggerPrice" validate:"required"`
+	// StopPrice makes the stop order a stop_limit order with that price
+	// instead of a stop order
+	StopPrice           string     `json:"stopPrice"`
+	TimeInForce         string     `json:"timeInForce" validate:"omitempty,oneof=GTC GTD"` // defaults to "GTC"
+	ExpiresAt           *time.Time `json:"expiresAt"`                                      // required for GTD pairs
+	SelfTradePrevention string     `json:"selfTradePrevention" validate:"omitempty,oneof=cancel_newest cancel_oldest cancel_both decrement"`
 }
 
-type GetOpenOrdersPayload struct {
-	TokenID uint `json:"tokenId" validate:"required"`
+type PlaceOCOResponse struct {
+	LimitOrder *Order   `json:"limitOrder"`
+	StopOrder  *Order   `json:"stopOrder"`
+	Trades     []*Trade `json:"trades"`
+}
+
+// AmendOrderPayload changes the price and/or the total amount of an order on
+// the book. Either may be left out to keep it as it is.
+type AmendOrderPayload struct {
+	Price  string `json:"price"`
+	Amount string `json:"amount"`
+}
+
+// CancelAllOrdersPayload narrows a cancel-all down to one token and/or side
+type CancelAllOrdersPayload struct {
+	TokenID   uint   `json:"tokenId"`
+	OrderType string `json:"orderType" validate:"omitempty,oneof=buy sell"`
+}
+
+type CancelOrdersPayload struct {
+	OrderIDs []uint `json:"orderIds" validate:"required,min=1,max=100"`
 }
 
-type GetUserOrdersPayload struct {
-	UserID uint `json:"userId" validate:"required"`
+type CancelOrdersResponse struct {
+	CancelledOrderIDs []uint `json:"cancelledOrderIds"`
 }
 
-type GetUserTradesPayload struct {
-	UserID uint `json:"userId" validate:"required"`
+type HaltTradingPayload struct {
+	Reason string `json:"reason" validate:"required,max=255"`
+}
+
+type ExecuteOrderPayload struct {
+	OrderID uint   `json:"orderId" validate:"required"`
+	Amount  string `json:"amount"` // defaults to the order's remaining amount
+}
+
+type GetOpenOrdersPayload struct {
+	TokenID uint `json:"tokenId" validate:"required"`
 }
 
 type GetTokenBalancePayload struct {